@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// writeJSON sends the given value to the client as an (indented) JSON
+// document.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Error writing JSON response")
+	}
+}
+
+// snapshotHandler serves the most recently collected data from the gateway
+// as a JSON document.  If the last collection is older than the configured
+// snapshot_max_age, a new one is performed first.
+func snapshotHandler(c *powerwallCollector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, c.snapshot(config.Web.SnapshotMaxAge))
+	}
+}
@@ -1,21 +1,40 @@
 package main
 
 import (
-	"net"
+	"math"
+	"sync"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/foogod/go-powerwall"
 )
 
 type powerwallCollector struct{
 	pw *powerwall.Client
+	gateway *gatewayClient
+	mu sync.Mutex
+	latest *Snapshot
+	lastError *collectionError
+	listeners []func(*Snapshot)
+	extensions []collectorExtension
 	metrics map[string]*prometheus.Desc
 }
 
+// A collectorExtension provides additional metrics which are derived from the
+// data the collector fetches (usually by keeping track of it over time).
+// Extensions register their metric descriptions with newDesc when they are
+// created.  update is called with each new snapshot as it is fetched (with
+// the same restrictions as listeners), and collect is called at the end of
+// each collection, after the snapshot being collected has been passed to
+// update.
+type collectorExtension interface {
+	update(snap *Snapshot)
+	collect(c *powerwallCollector, ch chan<- prometheus.Metric)
+}
+
 func NewPowerwallCollector(client *powerwall.Client) *powerwallCollector {
 	c := powerwallCollector{
 		pw: client,
+		gateway: newGatewayClient(client),
 		metrics: make(map[string]*prometheus.Desc),
 	}
 	c.newDesc("info", "Device Information", []string{"version", "git_hash"})
@@ -34,6 +53,16 @@ func NewPowerwallCollector(client *powerwall.Client) *powerwallCollector {
 	c.newDesc("full_pack_joules", "Total capacity of all batteries", nil)
 	c.newDesc("remaining_joules", "Remaining charge in all batteries", nil)
 	c.newDesc("island_state", "Whether powerwall is running in island mode or connected to grid", []string{"state"})
+	c.newDesc("expected_remaining_joules", "Expected remaining charge in all batteries", nil)
+	c.newDesc("battery_blocks_available", "Number of batteries available to the system", nil)
+	c.newDesc("max_charge_power_watts", "Maximum sustained charging power of all batteries", nil)
+	c.newDesc("max_discharge_power_watts", "Maximum sustained discharging power of all batteries", nil)
+	c.newDesc("max_apparent_power_watts", "Maximum apparent power of all battery inverters", nil)
+	c.newDesc("instantaneous_max_charge_power_watts", "Maximum charging power of all batteries at this moment", nil)
+	c.newDesc("instantaneous_max_discharge_power_watts", "Maximum discharging power of all batteries at this moment", nil)
+	c.newDesc("battery_target_power_watts", "Real power the batteries are being told to supply (positive is discharging, negative is charging)", nil)
+	c.newDesc("battery_target_reactive_power_watts", "Reactive power the batteries are being told to supply", nil)
+	c.newDesc("solar_real_power_limit_watts", "Limit currently placed on solar output", nil)
 
 	// battery info
 	c.newDesc("battery_info", "Battery Information", []string{"serial", "partno", "version"})
@@ -42,6 +71,9 @@ func NewPowerwallCollector(client *powerwall.Client) *powerwallCollector {
 	c.newDesc("battery_output_volts", "Battery voltage", []string{"serial"})
 	c.newDesc("battery_output_amps", "Battery current flow (positive is discharging, negative is charging)", []string{"serial"})
 	c.newDesc("battery_output_hz", "Battery output frequency", []string{"serial"})
+	c.newDesc("battery_nominal_volts", "Battery nominal voltage", []string{"serial"})
+	c.newDesc("battery_max_amps", "Battery maximum current", []string{"serial"})
+	c.newDesc("battery_disabled", "Has battery been disabled by the system?", []string{"serial"})
 	c.newDesc("battery_charged_joules_total", "Total amount of energy charged over battery's lifetime", []string{"serial"})
 	c.newDesc("battery_discharged_joules_total", "Total amount of energy discharged over battery's lifetime", []string{"serial"})
 	c.newDesc("battery_off_grid", "Is battery disconnected from the grid?", []string{"serial"})
@@ -74,6 +106,13 @@ func NewPowerwallCollector(client *powerwall.Client) *powerwallCollector {
 	c.newDesc("dev_instant_average_volts", "Instant Average Voltage", []string{"category", "tyoe", "serial"})
 	c.newDesc("dev_instant_average_amps", "Instant Average Current", []string{"category", "tyoe", "serial"})
 	c.newDesc("dev_instant_total_amps", "Instant Total Current", []string{"category", "tyoe", "serial"})
+	// (These use the same labels as the other dev_ metrics, so they can
+	// be matched up with them.)
+	c.newDesc("dev_phase_power_watts", "Per-phase Real Power (W)", []string{"category", "tyoe", "serial", "phase"})
+	c.newDesc("dev_phase_reactive_power_watts", "Per-phase Reactive Power (W)", []string{"category", "tyoe", "serial", "phase"})
+	c.newDesc("dev_phase_apparent_power_watts", "Per-phase Apparent Power (W)", []string{"category", "tyoe", "serial", "phase"})
+	c.newDesc("dev_phase_volts", "Per-phase Line-to-Neutral Voltage", []string{"category", "tyoe", "serial", "phase"})
+	c.newDesc("dev_phase_amps", "Per-phase Current", []string{"category", "tyoe", "serial", "phase"})
 
 	// network interfaces
 	c.newDesc("network_enabled", "Is network interface enabled?", []string{"type", "name"})
@@ -97,53 +136,35 @@ func (c *powerwallCollector) setCounter64(ch chan<- prometheus.Metric, name stri
 	ch <- prometheus.MustNewConstMetric(c.metrics[name], prometheus.CounterValue, value, labels...)
 }
 
+func (c *powerwallCollector) setHistogram(ch chan<- prometheus.Metric, name string, count uint64, sum float64, buckets map[float64]uint64, labels ...string) {
+	ch <- prometheus.MustNewConstHistogram(c.metrics[name], count, sum, buckets, labels...)
+}
+
 func (c *powerwallCollector) setCounter(ch chan<- prometheus.Metric, name string, value float32, labels ...string) {
 	c.setCounter64(ch, name, float64(value), labels...)
 }
 
 func (c *powerwallCollector) Collect(ch chan<- prometheus.Metric) {
-	log.Debug("Collecting metrics...")
+	// If the background poller is running, it's fine to just use its
+	// most recent data.
+	snap := c.snapshot(config.Device.PollInterval)
 
-	status, err := c.pw.GetStatus()
-	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Error("Error fetching status info")
-		if _, ok := err.(net.Error); ok {
-			return
-		}
-	} else {
+	if status := snap.Status; status != nil {
 		c.setGauge(ch, "info", 1, status.Version, status.GitHash)
 		c.setCounter64(ch, "uptime_seconds", status.UpTime.Seconds())
 		c.setCounter64(ch, "commission_count", float64(status.CommissionCount))
 	}
 
-	soe, err := c.pw.GetSOE()
-	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Error("Error fetching SOE info")
-		if _, ok := err.(net.Error); ok {
-			return
-		}
-	} else {
+	if soe := snap.SOE; soe != nil {
 		c.setGauge(ch, "charge_ratio", soe.Percentage / 100)
 	}
 
-	opdata, err := c.pw.GetOperation()
-	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Error("Error fetching operation info")
-		if _, ok := err.(net.Error); ok {
-			return
-		}
-	} else {
+	if opdata := snap.Operation; opdata != nil {
 		c.setGauge(ch, "operation_mode", 1, opdata.RealMode)
 		c.setGauge(ch, "reserve_ratio", opdata.BackupReservePercent / 100)
 	}
 
-	sitemaster, err := c.pw.GetSitemaster()
-	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Error("Error fetching sitemaster info")
-		if _, ok := err.(net.Error); ok {
-			return
-		}
-	} else {
+	if sitemaster := snap.Sitemaster; sitemaster != nil {
 		c.setGaugeBool(ch, "sitemaster_running", sitemaster.Running)
 		c.setGaugeBool(ch, "sitemaster_connected", sitemaster.ConnectedToTesla)
 		c.setGaugeBool(ch, "power_supply_mode", sitemaster.PowerSupplyMode)
@@ -152,26 +173,24 @@ func (c *powerwallCollector) Collect(ch chan<- prometheus.Metric) {
 		}
 	}
 
-	problems, err := c.pw.GetProblems()
-	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Error("Error fetching troubleshooting problems info")
-		if _, ok := err.(net.Error); ok {
-			return
-		}
-	} else {
+	if problems := snap.Problems; problems != nil {
 		c.setGauge64(ch, "problems_detected_count", float64(len(problems.Problems)))
 	}
 
-	sysstatus, err := c.pw.GetSystemStatus()
-	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Error("Error fetching system_status info")
-		if _, ok := err.(net.Error); ok {
-			return
-		}
-	} else {
+	if sysstatus := snap.SystemStatus; sysstatus != nil {
 		c.setGauge(ch, "full_pack_joules", sysstatus.NominalFullPackEnergy * 3600)
 		c.setGauge(ch, "remaining_joules", sysstatus.NominalEnergyRemaining * 3600)
 		c.setGauge(ch, "island_state", 1, sysstatus.SystemIslandState)
+		c.setGauge(ch, "expected_remaining_joules", sysstatus.ExpectedEnergyRemaining * 3600)
+		c.setGauge64(ch, "battery_blocks_available", float64(sysstatus.AvailableBlocks))
+		c.setGauge(ch, "max_charge_power_watts", sysstatus.MaxChargePower)
+		c.setGauge(ch, "max_discharge_power_watts", sysstatus.MaxDischargePower)
+		c.setGauge(ch, "max_apparent_power_watts", sysstatus.MaxApparentPower)
+		c.setGauge(ch, "instantaneous_max_charge_power_watts", sysstatus.InstantaneousMaxChargePower)
+		c.setGauge(ch, "instantaneous_max_discharge_power_watts", sysstatus.InstantaneousMaxDischargePower)
+		c.setGauge(ch, "battery_target_power_watts", sysstatus.BatteryTargetPower)
+		c.setGauge(ch, "battery_target_reactive_power_watts", sysstatus.BatteryTargetReactivePower)
+		c.setGauge(ch, "solar_real_power_limit_watts", sysstatus.SolarRealPowerLimit)
 
 		for _, block := range sysstatus.BatteryBlocks {
 			serial := block.PackageSerialNumber
@@ -181,6 +200,15 @@ func (c *powerwallCollector) Collect(ch chan<- prometheus.Metric) {
 			c.setGauge(ch, "battery_output_volts", block.VOut, serial)
 			c.setGauge(ch, "battery_output_amps", block.IOut, serial)
 			c.setGauge(ch, "battery_output_hz", block.FOut, serial)
+			if limits, ok := snap.BlockLimits[serial]; ok {
+				if limits.NominalVoltage != nil {
+					c.setGauge64(ch, "battery_nominal_volts", *limits.NominalVoltage, serial)
+				}
+				if limits.MaxCurrent != nil {
+					c.setGauge64(ch, "battery_max_amps", *limits.MaxCurrent, serial)
+				}
+			}
+			c.setGaugeBool(ch, "battery_disabled", len(block.DisabledReasons) > 0, serial)
 			c.setGaugeBool(ch, "battery_off_grid", block.OffGrid, serial)
 			c.setGaugeBool(ch, "battery_island_state", block.VfMode, serial)
 			c.setGaugeBool(ch, "battery_wobble_detected", block.WobbleDetected, serial)
@@ -206,90 +234,111 @@ func (c *powerwallCollector) Collect(ch chan<- prometheus.Metric) {
 		}
 	}
 
-	aggs, err := c.pw.GetMetersAggregates()
-	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Error("Error fetching meter aggregates info")
-		if _, ok := err.(net.Error); ok {
-			return
+	for cat, data := range snap.Aggregates {
+		c.setGauge(ch, "instant_power_watts", data.InstantPower, cat)
+		c.setGauge(ch, "instant_reactive_power_watts", data.InstantReactivePower, cat)
+		c.setGauge(ch, "instant_apparent_power_watts", data.InstantApparentPower, cat)
+		if data.Frequency != 0 {
+			c.setGauge(ch, "frequency_hz", data.Frequency, cat)
+		}
+		c.setGauge(ch, "instant_average_volts", data.InstantAverageVoltage, cat)
+		c.setGauge(ch, "instant_average_amps", data.InstantAverageCurrent, cat)
+		c.setGauge(ch, "instant_total_amps", data.InstantTotalCurrent, cat)
+
+		// In some circumstances, the powerwall can apparently
+		// report "0" for these stats for some time when
+		// starting up, etc (but then start showing the correct
+		// values once it's fully running).  This can screw up
+		// Prometheus by making it think that the counters have
+		// been reset when they actually haven't, so we just
+		// don't report these stats if they're showing zero.
+		if data.EnergyExported != 0 {
+			c.setCounter64(ch, "exported_joules_total", float64(data.EnergyExported) * 3600, cat)
 		}
-	} else {
-		for cat, data := range *aggs {
-			c.setGauge(ch, "instant_power_watts", data.InstantPower, cat)
-			c.setGauge(ch, "instant_reactive_power_watts", data.InstantReactivePower, cat)
-			c.setGauge(ch, "instant_apparent_power_watts", data.InstantApparentPower, cat)
+		if data.EnergyImported != 0 {
+			c.setCounter64(ch, "imported_joules_total", float64(data.EnergyImported) * 3600, cat)
+		}
+
+		for i, dev := range snap.Meters[cat] {
+			devtype := dev.Type
+			serial := dev.Connection.DeviceSerial
+			data := dev.CachedReadings
+			var extra meterExtraReadings
+			if i < len(snap.MeterReadings[cat]) {
+				extra = snap.MeterReadings[cat][i]
+			}
+			c.setGauge(ch, "dev_instant_power_watts", data.InstantPower, cat, devtype, serial)
+			c.setGauge(ch, "dev_instant_reactive_power_watts", data.InstantReactivePower, cat, devtype, serial)
+			c.setGauge(ch, "dev_instant_apparent_power_watts", data.InstantApparentPower, cat, devtype, serial)
 			if data.Frequency != 0 {
-				c.setGauge(ch, "frequency_hz", data.Frequency, cat)
+				c.setGauge(ch, "dev_frequency_hz", data.Frequency, cat, devtype, serial)
+			}
+			c.setGauge(ch, "dev_instant_average_volts", data.InstantAverageVoltage, cat, devtype, serial)
+			c.setGauge(ch, "dev_instant_average_amps", data.InstantAverageCurrent, cat, devtype, serial)
+			c.setGauge(ch, "dev_instant_total_amps", data.InstantTotalCurrent, cat, devtype, serial)
+
+			// Phases with no readings at all aren't connected (e.g.
+			// phase C on a split-phase site), so we leave them out.
+			phases := []struct {
+				phase string
+				power, reactive, volts, amps float32
+			}{
+				{"A", data.RealPowerA, data.ReactivePowerA, data.VL1N, data.IACurrent},
+				{"B", data.RealPowerB, data.ReactivePowerB, data.VL2N, data.IBCurrent},
+				{"C", extra.RealPowerC, extra.ReactivePowerC, extra.VL3N, data.ICCurrent},
+			}
+			for _, p := range phases {
+				if p.power == 0 && p.reactive == 0 && p.volts == 0 && p.amps == 0 {
+					continue
+				}
+				c.setGauge(ch, "dev_phase_power_watts", p.power, cat, devtype, serial, p.phase)
+				c.setGauge(ch, "dev_phase_reactive_power_watts", p.reactive, cat, devtype, serial, p.phase)
+				// Not reported, but easily worked out
+				c.setGauge64(ch, "dev_phase_apparent_power_watts", math.Hypot(float64(p.power), float64(p.reactive)), cat, devtype, serial, p.phase)
+				c.setGauge(ch, "dev_phase_volts", p.volts, cat, devtype, serial, p.phase)
+				c.setGauge(ch, "dev_phase_amps", p.amps, cat, devtype, serial, p.phase)
 			}
-			c.setGauge(ch, "instant_average_volts", data.InstantAverageVoltage, cat)
-			c.setGauge(ch, "instant_average_amps", data.InstantAverageCurrent, cat)
-			c.setGauge(ch, "instant_total_amps", data.InstantTotalCurrent, cat)
 
-			// In some circumstances, the powerwall can apparently
-			// report "0" for these stats for some time when
-			// starting up, etc (but then start showing the correct
-			// values once it's fully running).  This can screw up
-			// Prometheus by making it think that the counters have
-			// been reset when they actually haven't, so we just
-			// don't report these stats if they're showing zero.
+			// (see comment above about exported/imported counters on power-up)
 			if data.EnergyExported != 0 {
-				c.setCounter64(ch, "exported_joules_total", float64(data.EnergyExported) * 3600, cat)
+				c.setCounter64(ch, "dev_exported_joules_total", float64(data.EnergyExported) * 3600, cat, devtype, serial)
 			}
 			if data.EnergyImported != 0 {
-				c.setCounter64(ch, "imported_joules_total", float64(data.EnergyImported) * 3600, cat)
-			}
-
-			devs, err := c.pw.GetMeters(cat)
-			if err != nil {
-				log.WithFields(log.Fields{"cat": cat, "err": err}).Error("Error fetching detailed meter info")
-			} else {
-				for _, dev := range *devs {
-					devtype := dev.Type
-					serial := dev.Connection.DeviceSerial
-					data := dev.CachedReadings
-					c.setGauge(ch, "dev_instant_power_watts", data.InstantPower, cat, devtype, serial)
-					c.setGauge(ch, "dev_instant_reactive_power_watts", data.InstantReactivePower, cat, devtype, serial)
-					c.setGauge(ch, "dev_instant_apparent_power_watts", data.InstantApparentPower, cat, devtype, serial)
-					if data.Frequency != 0 {
-						c.setGauge(ch, "dev_frequency_hz", data.Frequency, cat, devtype, serial)
-					}
-					c.setGauge(ch, "dev_instant_average_volts", data.InstantAverageVoltage, cat, devtype, serial)
-					c.setGauge(ch, "dev_instant_average_amps", data.InstantAverageCurrent, cat, devtype, serial)
-					c.setGauge(ch, "dev_instant_total_amps", data.InstantTotalCurrent, cat, devtype, serial)
-
-					// (see comment above about exported/imported counters on power-up)
-					if data.EnergyExported != 0 {
-						c.setCounter64(ch, "dev_exported_joules_total", float64(data.EnergyExported) * 3600, cat, devtype, serial)
-					}
-					if data.EnergyImported != 0 {
-						c.setCounter64(ch, "dev_imported_joules_total", float64(data.EnergyImported) * 3600, cat, devtype, serial)
-					}
-				}
+				c.setCounter64(ch, "dev_imported_joules_total", float64(data.EnergyImported) * 3600, cat, devtype, serial)
 			}
 		}
 	}
 
-	nets, err := c.pw.GetNetworks()
-	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Error("Error fetching networks info")
-		if _, ok := err.(net.Error); ok {
-			return
-		}
-	} else {
-		for _, net := range *nets {
-			name := net.NetworkName
-			nettype := net.Interface
-			c.setGaugeBool(ch, "network_enabled", net.Enabled, nettype, name)
-			c.setGaugeBool(ch, "network_active", net.Active, nettype, name)
-			c.setGaugeBool(ch, "network_primary", net.Primary, nettype, name)
-			iface := net.IfaceNetworkInfo
-			if iface.NetworkName != "" {
-				c.setGauge(ch, "network_state", 1, nettype, name, iface.State, iface.StateReason)
-				if iface.SignalStrength != 0 {
-					c.setGauge64(ch, "network_signal_strength", float64(iface.SignalStrength), nettype, name)
-				}
+	for _, net := range snap.Networks {
+		name := net.NetworkName
+		nettype := net.Interface
+		c.setGaugeBool(ch, "network_enabled", net.Enabled, nettype, name)
+		c.setGaugeBool(ch, "network_active", net.Active, nettype, name)
+		c.setGaugeBool(ch, "network_primary", net.Primary, nettype, name)
+		iface := net.IfaceNetworkInfo
+		if iface.NetworkName != "" {
+			c.setGauge(ch, "network_state", 1, nettype, name, iface.State, iface.StateReason)
+			if iface.SignalStrength != 0 {
+				c.setGauge64(ch, "network_signal_strength", float64(iface.SignalStrength), nettype, name)
 			}
 		}
 	}
+
+	c.mu.Lock()
+	extensions := c.extensions
+	c.mu.Unlock()
+	for _, e := range extensions {
+		e.collect(c, ch)
+	}
+}
+
+// addExtension registers an extension to provide additional metrics.  This
+// must be done before the collector is used.
+func (c *powerwallCollector) addExtension(e collectorExtension) {
+	c.addListener(e.update)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.extensions = append(c.extensions, e)
 }
 
 func (c *powerwallCollector) newDesc(name string, desc string, labels []string) {
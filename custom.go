@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	customMetricGauge = "gauge"
+	customMetricCounter = "counter"
+
+	// A label source which gives the key (or list index) of the object
+	// containing the selected value, instead of one of its fields.
+	customLabelKey = "@key"
+)
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	selectorPartRE = regexp.MustCompile(`^([^\[\]]*)((?:\[(?:\*|[0-9]+)\])*)$`)
+)
+
+type CustomMetricConfig struct {
+	Name string `yaml:"name"`
+	Help string `yaml:"help"`
+	API string `yaml:"api"`
+	Path string `yaml:"path"`
+	Type string `yaml:"type"`
+	Labels map[string]string `yaml:"labels"`
+	Scale float64 `yaml:"scale"`
+	selector []selectorStep
+	labelNames []string
+}
+
+func setCustomMetricDefaults(c *CustomMetricConfig) {
+	if c.Type == "" {
+		c.Type = customMetricGauge
+	}
+	if c.Scale == 0 {
+		c.Scale = 1
+	}
+	if c.Help == "" {
+		c.Help = fmt.Sprintf("Value of %s from the %s API", c.Path, c.API)
+	}
+}
+
+func checkCustomMetricConfig(c *CustomMetricConfig) {
+	if c.Name == "" {
+		log.Fatal("Required parameter name not specified for entry in custom_metrics")
+	}
+	if !metricNameRE.MatchString(c.Name) {
+		log.Fatalf("Invalid metric name %q in custom_metrics", c.Name)
+	}
+	if c.API == "" {
+		log.Fatalf("Required parameter api not specified for custom_metrics entry %q", c.Name)
+	}
+	if c.Path == "" {
+		log.Fatalf("Required parameter path not specified for custom_metrics entry %q", c.Name)
+	}
+	if c.Type != customMetricGauge && c.Type != customMetricCounter {
+		log.Fatalf("Invalid type %q for custom_metrics entry %q (must be %q or %q)", c.Type, c.Name, customMetricGauge, customMetricCounter)
+	}
+	var err error
+	c.selector, err = parseSelector(c.Path)
+	if err != nil {
+		log.Fatalf("Invalid path for custom_metrics entry %q: %s", c.Name, err)
+	}
+	c.labelNames = []string{}
+	for label, field := range c.Labels {
+		if !labelNameRE.MatchString(label) {
+			log.Fatalf("Invalid label name %q for custom_metrics entry %q", label, c.Name)
+		}
+		if field == "" {
+			log.Fatalf("No field given for label %q of custom_metrics entry %q", label, c.Name)
+		}
+		c.labelNames = append(c.labelNames, label)
+	}
+	sort.Strings(c.labelNames)
+}
+
+// A selectorStep is one step of a path through a JSON document: either an
+// object key ("*" for all of them), or a list index (-1 for all of them).
+type selectorStep struct {
+	key string
+	index int
+	isIndex bool
+}
+
+// parseSelector parses a (very) simplified JSONPath expression, such as
+// "battery_blocks[*].v_out" or "$.site.instant_power".  Keys are separated
+// by dots, "*" matches every key of an object, and "[n]" or "[*]" selects
+// one or all entries of a list.
+func parseSelector(path string) ([]selectorStep, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	steps := []selectorStep{}
+	if path == "" {
+		return steps, nil
+	}
+	for _, part := range strings.Split(path, ".") {
+		m := selectorPartRE.FindStringSubmatch(part)
+		if m == nil || (m[1] == "" && m[2] == "") {
+			return nil, fmt.Errorf("invalid selector component %q", part)
+		}
+		if m[1] != "" {
+			steps = append(steps, selectorStep{key: m[1]})
+		}
+		for _, idx := range strings.Split(strings.TrimSuffix(m[2], "]"), "]") {
+			idx = strings.TrimPrefix(idx, "[")
+			if idx == "" {
+				continue
+			}
+			n := -1
+			if idx != "*" {
+				n, _ = strconv.Atoi(idx)
+			}
+			steps = append(steps, selectorStep{index: n, isIndex: true})
+		}
+	}
+	return steps, nil
+}
+
+// A selectorMatch is a value found by a selector, along with the object it
+// was found in (if any) and the key or index of that object within its own
+// parent, which are where labels come from.
+type selectorMatch struct {
+	value interface{}
+	parent map[string]interface{}
+	parentKey string
+}
+
+// selectValues applies the selector steps to a decoded JSON value and returns
+// everything it matches.
+func selectValues(value interface{}, steps []selectorStep) []selectorMatch {
+	matches := []selectorMatch{}
+	var walk func(v interface{}, steps []selectorStep, parent map[string]interface{}, key, parentKey string)
+	walk = func(v interface{}, steps []selectorStep, parent map[string]interface{}, key, parentKey string) {
+		if len(steps) == 0 {
+			matches = append(matches, selectorMatch{value: v, parent: parent, parentKey: parentKey})
+			return
+		}
+		step := steps[0]
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if step.isIndex {
+				return
+			}
+			if step.key != "*" {
+				if child, ok := v[step.key]; ok {
+					walk(child, steps[1:], v, step.key, key)
+				}
+				return
+			}
+			keys := []string{}
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				walk(v[k], steps[1:], v, k, key)
+			}
+		case []interface{}:
+			if !step.isIndex {
+				return
+			}
+			for i, child := range v {
+				if step.index < 0 || step.index == i {
+					// List entries don't belong to an object,
+					// so the parent carries through.
+					walk(child, steps[1:], parent, strconv.Itoa(i), key)
+				}
+			}
+		}
+	}
+	walk(value, steps, nil, "", "")
+	return matches
+}
+
+// jsonNumber converts a JSON value into a metric value, if it can be.
+func jsonNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// jsonLabel converts a JSON value into a label value.
+func jsonLabel(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	text, _ := json.Marshal(v)
+	return string(text)
+}
+
+type customSample struct {
+	value float64
+	labels []string
+}
+
+// customMetrics exports arbitrary values from the gateway's raw API responses,
+// as set up in the custom_metrics section of the config file.  The APIs are
+// fetched in the background after each new snapshot, so the values lag one
+// collection behind.
+type customMetrics struct {
+	metrics []CustomMetricConfig
+	apis []string
+	gateway *gatewayClient
+	mu sync.Mutex
+	running bool
+	samples map[string][]customSample
+}
+
+func newCustomMetrics(c *powerwallCollector, metrics []CustomMetricConfig, gateway *gatewayClient) *customMetrics {
+	m := &customMetrics{
+		metrics: metrics,
+		gateway: gateway,
+		samples: make(map[string][]customSample),
+	}
+	seen := make(map[string]bool)
+	for _, cm := range metrics {
+		if _, ok := c.metrics[cm.Name]; ok {
+			log.Fatalf("custom_metrics entry %q has the same name as an existing metric", cm.Name)
+		}
+		c.newDesc(cm.Name, cm.Help, cm.labelNames)
+		if !seen[cm.API] {
+			seen[cm.API] = true
+			m.apis = append(m.apis, cm.API)
+		}
+	}
+	return m
+}
+
+func (m *customMetrics) update(snap *Snapshot) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running {
+		return
+	}
+	m.running = true
+	go m.fetch()
+}
+
+func (m *customMetrics) fetch() {
+	ctx, span := tracer.Start(context.Background(), "CustomMetrics")
+	defer span.End()
+	samples := make(map[string][]customSample)
+	for _, api := range m.apis {
+		apiCtx, apiSpan := startGatewaySpan(ctx, "GET " + api)
+		body, _, err := m.gateway.get(apiCtx, api)
+		endGatewaySpan(apiSpan, err)
+		var doc interface{}
+		if err == nil {
+			err = json.Unmarshal(body, &doc)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"api": api, "err": err}).Error("Error fetching API for custom metrics")
+			continue
+		}
+		for _, cm := range m.metrics {
+			if cm.API != api {
+				continue
+			}
+			seen := make(map[string]bool)
+			for _, match := range selectValues(doc, cm.selector) {
+				value, ok := jsonNumber(match.value)
+				if !ok {
+					continue
+				}
+				labels := make([]string, len(cm.labelNames))
+				for i, name := range cm.labelNames {
+					field := cm.Labels[name]
+					if field == customLabelKey {
+						labels[i] = match.parentKey
+					} else if match.parent != nil {
+						labels[i] = jsonLabel(match.parent[field])
+					}
+				}
+				// Prometheus won't accept the same labels twice
+				// for one metric.
+				key := strings.Join(labels, "\x00")
+				if seen[key] {
+					log.WithFields(log.Fields{"metric": cm.Name, "labels": labels}).Debug("Duplicate custom metric value ignored")
+					continue
+				}
+				seen[key] = true
+				samples[cm.Name] = append(samples[cm.Name], customSample{value: value * cm.Scale, labels: labels})
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.running = false
+	m.samples = samples
+}
+
+func (m *customMetrics) collect(c *powerwallCollector, ch chan<- prometheus.Metric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, cm := range m.metrics {
+		for _, s := range m.samples[cm.Name] {
+			if cm.Type == customMetricCounter {
+				c.setCounter64(ch, cm.Name, s.value, s.labels...)
+			} else {
+				c.setGauge64(ch, cm.Name, s.value, s.labels...)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		path string
+		want []selectorStep
+	}{
+		{"", []selectorStep{}},
+		{"$", []selectorStep{}},
+		{"percentage", []selectorStep{{key: "percentage"}}},
+		{"$.site.instant_power", []selectorStep{{key: "site"}, {key: "instant_power"}}},
+		{"*.instant_power", []selectorStep{{key: "*"}, {key: "instant_power"}}},
+		{"battery_blocks[*].v_out", []selectorStep{{key: "battery_blocks"}, {index: -1, isIndex: true}, {key: "v_out"}}},
+		{"battery_blocks[1]", []selectorStep{{key: "battery_blocks"}, {index: 1, isIndex: true}}},
+		{"[0]", []selectorStep{{index: 0, isIndex: true}}},
+		{"a[0][*]", []selectorStep{{key: "a"}, {index: 0, isIndex: true}, {index: -1, isIndex: true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := parseSelector(tt.path)
+			if err != nil {
+				t.Fatalf("parseSelector(%q): %s", tt.path, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSelector(%q) = %+v, want %+v", tt.path, got, tt.want)
+			}
+		})
+	}
+
+	for _, path := range []string{"a..b", "a.", "a[x]", "a[-1]", "a[0", "a]", "a[0]b"} {
+		t.Run("invalid " + path, func(t *testing.T) {
+			if _, err := parseSelector(path); err == nil {
+				t.Errorf("parseSelector(%q) succeeded, want error", path)
+			}
+		})
+	}
+}
+
+func TestSelectValues(t *testing.T) {
+	doc := `{
+		"site": {"instant_power": 100, "frequency": 60},
+		"load": {"instant_power": 50},
+		"solar": {"frequency": 0},
+		"battery_blocks": [
+			{"PackageSerialNumber": "TG1", "v_out": 240.1},
+			{"PackageSerialNumber": "TG2", "v_out": 239.9},
+			{"PackageSerialNumber": "TG3"}
+		],
+		"percentage": 69.1
+	}`
+	var value interface{}
+	if err := json.Unmarshal([]byte(doc), &value); err != nil {
+		t.Fatal(err)
+	}
+	type match struct {
+		value interface{}
+		label string // the parent's PackageSerialNumber, if any
+		parentKey string
+	}
+	tests := []struct {
+		path string
+		want []match
+	}{
+		{"percentage", []match{{69.1, "", ""}}},
+		{"site.instant_power", []match{{100.0, "", "site"}}},
+		{"*.instant_power", []match{{50.0, "", "load"}, {100.0, "", "site"}}},
+		{"*.frequency", []match{{60.0, "", "site"}, {0.0, "", "solar"}}},
+		{"battery_blocks[*].v_out", []match{{240.1, "TG1", "0"}, {239.9, "TG2", "1"}}},
+		{"battery_blocks[1].v_out", []match{{239.9, "TG2", "1"}}},
+		{"battery_blocks[5].v_out", []match{}},
+		{"missing", []match{}},
+		// Keys don't match lists, and indexes don't match objects
+		{"battery_blocks.v_out", []match{}},
+		{"site[0]", []match{}},
+		{"percentage.value", []match{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			steps, err := parseSelector(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []match{}
+			for _, m := range selectValues(value, steps) {
+				label := ""
+				if m.parent != nil {
+					label, _ = m.parent["PackageSerialNumber"].(string)
+				}
+				got = append(got, match{m.value, label, m.parentKey})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
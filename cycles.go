@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	dischargeStateKey = "depth_of_discharge"
+	// The day's highest and lowest values change on just about every
+	// collection while the battery is charging or discharging, so only
+	// save them this often (new days are always saved straight away).
+	dischargeSaveInterval = time.Minute
+)
+
+var dischargeBuckets = []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1.0}
+
+// dischargeHistory is the saved state for a single battery.  Buckets holds
+// the (non-cumulative) number of days which fell into each of
+// dischargeBuckets.
+type dischargeHistory struct {
+	Day string `json:"day"`
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Count uint64 `json:"count"`
+	Sum float64 `json:"sum"`
+	Buckets []uint64 `json:"buckets"`
+	// When the gateway last reported this battery (see batteryHealth)
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// record adds a completed day's depth of discharge to the histogram.
+func (h *dischargeHistory) record(depth float64) {
+	if len(h.Buckets) != len(dischargeBuckets) {
+		h.Buckets = make([]uint64, len(dischargeBuckets))
+	}
+	h.Count++
+	h.Sum += depth
+	for i, upper := range dischargeBuckets {
+		if depth <= upper {
+			h.Buckets[i]++
+			break
+		}
+	}
+}
+
+// dischargeTracker records how deeply each battery is cycled each day (the
+// difference between its highest and lowest state of energy during the day,
+// in the site timezone).
+type dischargeTracker struct {
+	config *BatteriesConfig
+	store *stateStore
+	mu sync.Mutex
+	batteries map[string]*dischargeHistory
+	saved time.Time
+	dirty bool
+}
+
+func newDischargeTracker(c *powerwallCollector, bc *BatteriesConfig, store *stateStore) *dischargeTracker {
+	c.newDesc("battery_daily_depth_of_discharge_ratio", "Depth of discharge (highest minus lowest state of energy) of the battery on each completed day", []string{"serial"})
+	c.newDesc("battery_depth_of_discharge_today_ratio", "Depth of discharge (highest minus lowest state of energy) of the battery so far today", []string{"serial"})
+	t := &dischargeTracker{
+		config: bc,
+		store: store,
+		batteries: make(map[string]*dischargeHistory),
+	}
+	if store.get(dischargeStateKey, &t.batteries) {
+		log.WithFields(log.Fields{"batteries": len(t.batteries)}).Info("Restored depth of discharge history")
+		for _, h := range t.batteries {
+			if h.LastSeen.IsZero() {
+				h.LastSeen = time.Now()
+			}
+		}
+	}
+	return t
+}
+
+func (t *dischargeTracker) update(snap *Snapshot) {
+	if snap.SystemStatus == nil {
+		return
+	}
+	day := snap.Time.In(config.Site.location).Format("2006-01-02")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	changed := false
+	for _, block := range snap.SystemStatus.BatteryBlocks {
+		serial := block.PackageSerialNumber
+		if serial == "" || block.NominalFullPackEnergy <= 0 {
+			continue
+		}
+		soe := float64(block.NominalEnergyRemaining / block.NominalFullPackEnergy)
+		h, ok := t.batteries[serial]
+		if !ok {
+			h = &dischargeHistory{}
+			t.batteries[serial] = h
+		}
+		h.LastSeen = snap.Time
+		if h.Day != day {
+			if h.Day != "" {
+				h.record(h.Max - h.Min)
+			}
+			h.Day = day
+			h.Min = soe
+			h.Max = soe
+			changed = true
+		} else if soe < h.Min || soe > h.Max {
+			h.Min = math.Min(h.Min, soe)
+			h.Max = math.Max(h.Max, soe)
+			t.dirty = true
+		}
+	}
+	for serial, h := range t.batteries {
+		if snap.Time.Sub(h.LastSeen) > t.config.ForgetAfter {
+			log.WithFields(log.Fields{"serial": serial, "last_seen": h.LastSeen}).Info("Battery has not been reported for a long time.  Forgetting its depth of discharge history.")
+			delete(t.batteries, serial)
+			changed = true
+		}
+	}
+	if changed || (t.dirty && snap.Time.Sub(t.saved) >= dischargeSaveInterval) {
+		t.store.set(dischargeStateKey, t.batteries)
+		t.saved = snap.Time
+		t.dirty = false
+	}
+}
+
+func (t *dischargeTracker) collect(c *powerwallCollector, ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	serials := []string{}
+	for serial := range t.batteries {
+		serials = append(serials, serial)
+	}
+	sort.Strings(serials)
+	for _, serial := range serials {
+		h := t.batteries[serial]
+		c.setGauge64(ch, "battery_depth_of_discharge_today_ratio", h.Max - h.Min, serial)
+
+		buckets := make(map[float64]uint64)
+		cumulative := uint64(0)
+		for i, upper := range dischargeBuckets {
+			if i < len(h.Buckets) {
+				cumulative += h.Buckets[i]
+			}
+			buckets[upper] = cumulative
+		}
+		c.setHistogram(ch, "battery_daily_depth_of_discharge_ratio", h.Count, h.Sum, buckets, serial)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDischargeTrackerForget(t *testing.T) {
+	start := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	tests := []struct {
+		name string
+		// Serials reported at each time (offsets from start)
+		times []time.Duration
+		serials [][]string
+		want []string
+		wantDays uint64 // completed days recorded for TG1
+	}{
+		{
+			name: "all present",
+			times: []time.Duration{0, 40 * day},
+			serials: [][]string{{"TG1", "TG2"}, {"TG1", "TG2"}},
+			want: []string{"TG1", "TG2"},
+			wantDays: 1,
+		},
+		{
+			name: "dropped out for a while",
+			times: []time.Duration{0, day, 2 * day, 20 * day},
+			serials: [][]string{{"TG1", "TG2"}, {"TG1"}, {"TG1"}, {"TG1"}},
+			want: []string{"TG1", "TG2"},
+			wantDays: 3,
+		},
+		{
+			name: "replaced",
+			times: []time.Duration{0, day, 31 * day},
+			serials: [][]string{{"TG1", "TG2"}, {"TG1", "TG3"}, {"TG1", "TG3"}},
+			want: []string{"TG1", "TG3"},
+			wantDays: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := &BatteriesConfig{ForgetAfter: 30 * day}
+			tracker := newDischargeTracker(newTestCollector(t), bc, loadStateStore(""))
+			for i, offset := range tt.times {
+				tracker.update(batterySnapshot(t, start.Add(offset), tt.serials[i]...))
+			}
+			seen := make(map[string]bool)
+			for serial := range tracker.batteries {
+				seen[serial] = true
+			}
+			if got := sortedKeys(seen); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("batteries = %v, want %v", got, tt.want)
+			}
+			if got := tracker.batteries["TG1"].Count; got != tt.wantDays {
+				t.Errorf("days recorded = %d, want %d", got, tt.wantDays)
+			}
+		})
+	}
+}
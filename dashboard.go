@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dashboardBattery holds the details shown for each battery pack.
+type dashboardBattery struct {
+	Serial string
+	PartNumber string
+	ChargePercent float64
+	RemainingWh float32
+	FullWh float32
+	PowerWatts float32
+	Volts float32
+	State string
+	GridState string
+	BackupReady bool
+	OffGrid bool
+}
+
+// dashboardData contains everything the dashboard template needs.  Pointer
+// fields are nil if the corresponding data could not be fetched.
+type dashboardData struct {
+	Exporter string
+	Version string
+	MetricsPath string
+	ProjectURL string
+	RefreshSeconds int
+	Time time.Time
+
+	Solar *float32
+	Grid *float32
+	Battery *float32
+	Home *float32
+	SOC *float32
+	Reserve *float32
+	IslandState string
+	Batteries []dashboardBattery
+	Problems []string
+	Errors map[string]string
+	LastError *collectionError
+}
+
+func newDashboardData(c *powerwallCollector) *dashboardData {
+	snap := c.snapshot(config.Web.SnapshotMaxAge)
+	d := &dashboardData{
+		Exporter: exporterName,
+		Version: exporterVersion,
+		MetricsPath: config.Web.MetricsPath,
+		ProjectURL: projectURL,
+		RefreshSeconds: int(math.Ceil(config.Web.DashboardRefresh.Seconds())),
+		Time: snap.Time,
+		Errors: snap.Errors,
+		LastError: c.lastCollectionError(),
+	}
+
+	power := func(cat string) *float32 {
+		if data, ok := snap.Aggregates[cat]; ok {
+			return &data.InstantPower
+		}
+		return nil
+	}
+	d.Solar = power("solar")
+	d.Grid = power("site")
+	d.Battery = power("battery")
+	d.Home = power("load")
+
+	if snap.SOE != nil {
+		d.SOC = &snap.SOE.Percentage
+	}
+	if snap.Operation != nil {
+		d.Reserve = &snap.Operation.BackupReservePercent
+	}
+	if snap.SystemStatus != nil {
+		d.IslandState = snap.SystemStatus.SystemIslandState
+		for _, block := range snap.SystemStatus.BatteryBlocks {
+			b := dashboardBattery{
+				Serial: block.PackageSerialNumber,
+				PartNumber: block.PackagePartNumber,
+				RemainingWh: block.NominalEnergyRemaining,
+				FullWh: block.NominalFullPackEnergy,
+				PowerWatts: block.POut,
+				Volts: block.VOut,
+				State: block.PinvState,
+				GridState: block.PinvGridState,
+				BackupReady: block.BackupReady,
+				OffGrid: block.OffGrid,
+			}
+			if block.NominalFullPackEnergy > 0 {
+				b.ChargePercent = float64(block.NominalEnergyRemaining / block.NominalFullPackEnergy * 100)
+			}
+			d.Batteries = append(d.Batteries, b)
+		}
+	}
+	if snap.Problems != nil {
+		// We don't actually know what format problem reports come
+		// in, so just show them as JSON.
+		for _, p := range snap.Problems.Problems {
+			text, err := json.Marshal(p)
+			if err != nil {
+				text = []byte(fmt.Sprintf("%v", p))
+			}
+			d.Problems = append(d.Problems, string(text))
+		}
+	}
+	return d
+}
+
+var dashboardFuncs = template.FuncMap{
+	// kw formats a power value (in watts) as kilowatts, without sign
+	"kw": func(w float32) string {
+		return fmt.Sprintf("%.2f kW", math.Abs(float64(w)) / 1000)
+	},
+	// kwh formats an energy value (in Wh) as kilowatt-hours
+	"kwh": func(wh float32) string {
+		return fmt.Sprintf("%.1f kWh", wh / 1000)
+	},
+	"pct": func(v interface{}) string {
+		return fmt.Sprintf("%.1f%%", v)
+	},
+	// flowing reports whether a power value is large enough to be worth
+	// drawing as an active flow
+	"flowing": func(w *float32) bool {
+		return w != nil && math.Abs(float64(*w)) >= 10
+	},
+	"deref": func(v *float32) float32 {
+		return *v
+	},
+	"timefmt": func(t time.Time) string {
+		return t.In(config.Site.location).Format("2006-01-02 15:04:05 MST")
+	},
+}
+
+// The dashboard template is parsed once at startup (and will panic if there
+// is anything wrong with it, which should get caught long before release).
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(dashboardFuncs).Parse(dashboardHTML))
+
+// dashboardHandler serves the built-in status dashboard page (on "/").
+func dashboardHandler(c *powerwallCollector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// "/" matches every path nothing else has claimed, but we
+		// don't want things like favicon requests hitting the gateway.
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := dashboardTemplate.Execute(w, newDashboardData(c))
+		if err != nil {
+			log.Errorf("Error executing template for dashboard HTML (/): %s", err)
+		}
+	}
+}
+
+const dashboardHTML = `<!doctype html>
+<html>
+<head>
+        <meta charset="UTF-8">
+        <meta name="viewport" content="width=device-width, initial-scale=1">
+        <meta http-equiv="refresh" content="{{ .RefreshSeconds }}">
+        <title>{{ .Exporter }} exporter</title>
+        <style>
+                body { font-family: sans-serif; margin: 1em auto; max-width: 60em; padding: 0 1em; color: #222; background: #fafafa; }
+                h1 { font-size: 1.4em; }
+                h2 { font-size: 1.1em; margin-top: 1.5em; border-bottom: 1px solid #ccc; }
+                table { border-collapse: collapse; }
+                th, td { text-align: left; padding: 0.2em 0.8em 0.2em 0; }
+                .muted { color: #777; font-size: 0.9em; }
+                .error { color: #b00; }
+                .ok { color: #080; }
+                .flow { display: block; margin: 0 auto; max-width: 28em; }
+                .flow text { font-size: 13px; text-anchor: middle; }
+                .flow .label { font-weight: bold; }
+                .flow line { stroke: #ccc; stroke-width: 3; }
+                .flow line.active { stroke: #e8a317; stroke-dasharray: 8 6; animation: flow 1s linear infinite; }
+                .flow line.active.reverse { animation-direction: reverse; }
+                .flow circle { fill: #fff; stroke: #888; stroke-width: 2; }
+                @keyframes flow { to { stroke-dashoffset: -14; } }
+                .gauge { position: relative; height: 1.5em; width: 100%; max-width: 28em; background: #ddd; border-radius: 0.3em; overflow: hidden; }
+                .gauge .fill { height: 100%; background: #3a3; }
+                .gauge .reserve { position: absolute; top: 0; bottom: 0; border-left: 2px solid #b00; }
+        </style>
+</head>
+<body>
+        <h1>{{ .Exporter }} exporter for Prometheus (Version {{ .Version }})</h1>
+        <p class="muted">Data collected {{ timefmt .Time }}.  This page refreshes every {{ .RefreshSeconds }} seconds.</p>
+
+        <h2>Power flow</h2>
+        {{/* Lines are drawn from each device to the center, so a "forward"
+             animation means power flowing into the center, and "reverse"
+             means power flowing out to the device. */}}
+        <svg class="flow" viewBox="0 0 300 240">
+                <line x1="150" y1="40" x2="150" y2="120" class="{{ if flowing .Solar }}active{{ end }}"/>
+                <line x1="40" y1="120" x2="150" y2="120" class="{{ if flowing .Grid }}active{{ if lt (deref .Grid) 0.0 }} reverse{{ end }}{{ end }}"/>
+                <line x1="260" y1="120" x2="150" y2="120" class="{{ if flowing .Home }}active reverse{{ end }}"/>
+                <line x1="150" y1="200" x2="150" y2="120" class="{{ if flowing .Battery }}active{{ if lt (deref .Battery) 0.0 }} reverse{{ end }}{{ end }}"/>
+                <circle cx="150" cy="120" r="6"/>
+                <circle cx="150" cy="30" r="22"/>
+                <text x="150" y="34" class="label">Solar</text>
+                <text x="205" y="34">{{ with .Solar }}{{ kw . }}{{ else }}?{{ end }}</text>
+                <circle cx="30" cy="120" r="22"/>
+                <text x="30" y="124" class="label">Grid</text>
+                <text x="60" y="160">{{ with .Grid }}{{ kw . }} {{ if lt (deref .) 0.0 }}export{{ else }}import{{ end }}{{ else }}?{{ end }}</text>
+                <circle cx="270" cy="120" r="22"/>
+                <text x="270" y="124" class="label">Home</text>
+                <text x="245" y="160">{{ with .Home }}{{ kw . }}{{ else }}?{{ end }}</text>
+                <circle cx="150" cy="210" r="22"/>
+                <text x="150" y="214" class="label">Battery</text>
+                <text x="225" y="214">{{ with .Battery }}{{ kw . }} {{ if lt (deref .) 0.0 }}charging{{ else }}discharging{{ end }}{{ else }}?{{ end }}</text>
+        </svg>
+
+        <h2>Battery</h2>
+        {{ if .SOC }}
+        <div class="gauge">
+                <div class="fill" style="width: {{ deref .SOC }}%"></div>
+                {{ with .Reserve }}<div class="reserve" style="left: {{ . }}%" title="Backup reserve"></div>{{ end }}
+        </div>
+        <p>Charge: <b>{{ pct (deref .SOC) }}</b>{{ with .Reserve }} &mdash; Backup reserve: {{ pct (deref .) }}{{ end }}</p>
+        {{ else }}
+        <p class="error">Charge information not available</p>
+        {{ end }}
+        <p>Island state: <b>{{ or .IslandState "unknown" }}</b></p>
+        {{ if .Batteries }}
+        <table>
+                <tr><th>Serial</th><th>Part number</th><th>Charge</th><th>Remaining</th><th>Capacity</th><th>Power</th><th>Voltage</th><th>Inverter state</th><th>Grid state</th><th>Backup ready</th></tr>
+                {{ range .Batteries }}
+                <tr>
+                        <td>{{ .Serial }}</td>
+                        <td>{{ .PartNumber }}</td>
+                        <td>{{ pct .ChargePercent }}</td>
+                        <td>{{ kwh .RemainingWh }}</td>
+                        <td>{{ kwh .FullWh }}</td>
+                        <td>{{ kw .PowerWatts }} {{ if lt .PowerWatts 0.0 }}charging{{ else if gt .PowerWatts 0.0 }}discharging{{ end }}</td>
+                        <td>{{ printf "%.1f" .Volts }} V</td>
+                        <td>{{ .State }}</td>
+                        <td>{{ .GridState }}{{ if .OffGrid }} (off grid){{ end }}</td>
+                        <td>{{ if .BackupReady }}<span class="ok">yes</span>{{ else }}<span class="error">no</span>{{ end }}</td>
+                </tr>
+                {{ end }}
+        </table>
+        {{ end }}
+
+        <h2>Problems</h2>
+        {{ range .Problems }}
+        <p class="error"><code>{{ . }}</code></p>
+        {{ else }}
+        <p class="ok">No problems reported.</p>
+        {{ end }}
+
+        <h2>Collection status</h2>
+        {{ range $api, $msg := .Errors }}
+        <p class="error">Error fetching <code>{{ $api }}</code>: {{ $msg }}</p>
+        {{ else }}
+        <p class="ok">All data collected successfully.</p>
+        {{ end }}
+        {{ with .LastError }}
+        <p class="muted">Last collection error ({{ timefmt .Time }}, <code>{{ .API }}</code>): {{ .Message }}</p>
+        {{ end }}
+
+        <h2>More information:</h2>
+        <p>Exported metrics are available at <a href="{{ .MetricsPath }}">{{ .MetricsPath }}</a></p>
+        <p><a href="{{ .ProjectURL }}">{{ .ProjectURL }}</a></p>
+</body>
+</html>
+`
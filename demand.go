@@ -0,0 +1,226 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultDemandInterval = "15m"
+	defaultDemandSampleInterval = "10s"
+	defaultDemandResetDay = 1
+
+	demandStateKey = "demand"
+	// Even if nothing significant has changed, save the state this often,
+	// so we don't lose too much of the current interval if restarted.
+	demandSaveInterval = time.Minute
+)
+
+type DemandConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	SampleInterval time.Duration `yaml:"sample_interval"`
+	ResetDay int `yaml:"reset_day"`
+}
+
+func setDemandDefaults(c *DemandConfig) {
+	if c.Interval == 0 {
+		c.Interval, _ = time.ParseDuration(defaultDemandInterval)
+	}
+	if c.SampleInterval == 0 {
+		c.SampleInterval, _ = time.ParseDuration(defaultDemandSampleInterval)
+	}
+	if c.ResetDay == 0 {
+		c.ResetDay = defaultDemandResetDay
+	}
+}
+
+func checkDemandConfig(c *DemandConfig) {
+	if c.Interval <= 0 {
+		log.Fatal("demand.interval must be greater than zero")
+	}
+	if c.SampleInterval <= 0 || c.SampleInterval > c.Interval {
+		log.Fatal("demand.sample_interval must be greater than zero and no longer than demand.interval")
+	}
+	if c.ResetDay < 1 || c.ResetDay > 28 {
+		log.Fatal("demand.reset_day must be between 1 and 28")
+	}
+}
+
+// demandState is the part of the demand tracker's state which is saved
+// across restarts.
+type demandState struct {
+	CycleStart time.Time `json:"cycle_start"`
+	PeakWatts float64 `json:"peak_watts"`
+	PeakTime time.Time `json:"peak_time"`
+	IntervalStart time.Time `json:"interval_start"`
+	IntervalJoules float64 `json:"interval_joules"`
+	IntervalSeconds float64 `json:"interval_seconds"`
+}
+
+type demandSample struct {
+	time time.Time
+	watts float64
+}
+
+// demandTracker keeps track of average grid import power over fixed demand
+// intervals (the way utilities calculate demand charges), and the highest
+// such average in the current billing cycle.  It also keeps a rolling
+// average over the same length of time, which is useful for seeing how close
+// the current interval is likely to get to the peak.
+type demandTracker struct {
+	config *DemandConfig
+	store *stateStore
+	mu sync.Mutex
+	state demandState
+	last *demandSample
+	samples []demandSample
+	saved time.Time
+}
+
+func newDemandTracker(c *powerwallCollector, dc *DemandConfig, store *stateStore) *demandTracker {
+	c.newDesc("demand_rolling_watts", "Average grid import power over the most recent demand interval length", nil)
+	c.newDesc("demand_interval_watts", "Average grid import power so far in the current demand interval", nil)
+	c.newDesc("demand_peak_watts", "Highest average grid import power of any demand interval in the current billing cycle", nil)
+	c.newDesc("demand_peak_timestamp_seconds", "End time of the demand interval with the highest average grid import power in the current billing cycle", nil)
+	c.newDesc("demand_cycle_start_timestamp_seconds", "Start time of the current billing cycle", nil)
+	t := &demandTracker{config: dc, store: store}
+	if store.get(demandStateKey, &t.state) {
+		log.WithFields(log.Fields{"peak_watts": t.state.PeakWatts, "peak_time": t.state.PeakTime}).Info("Restored demand tracking state")
+	}
+	return t
+}
+
+// cycleStart returns the start of the billing cycle containing t (midnight
+// on the most recent reset day, in the site timezone).
+func (t *demandTracker) cycleStart(ts time.Time) time.Time {
+	ts = ts.In(config.Site.location)
+	y, m, d := ts.Date()
+	if d < t.config.ResetDay {
+		m--
+	}
+	return time.Date(y, m, t.config.ResetDay, 0, 0, 0, 0, config.Site.location)
+}
+
+// intervalStart returns the start of the demand interval containing t.
+// Intervals are aligned to the start of the day (in the site timezone), so
+// 15 minute intervals start on the hour, quarter past, etc.
+func (t *demandTracker) intervalStart(ts time.Time) time.Time {
+	ts = ts.In(config.Site.location)
+	y, m, d := ts.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, config.Site.location)
+	return midnight.Add(ts.Sub(midnight).Truncate(t.config.Interval))
+}
+
+// finishInterval works out the average for the current interval, and
+// records it as the new peak if it's the highest so far.
+func (t *demandTracker) finishInterval() {
+	s := &t.state
+	if s.IntervalSeconds > 0 {
+		avg := s.IntervalJoules / s.IntervalSeconds
+		end := s.IntervalStart.Add(t.config.Interval)
+		// When a new cycle has just started, the interval being
+		// finished is the last one of the old cycle, so it doesn't
+		// count.
+		if !s.IntervalStart.Before(s.CycleStart) && (s.PeakTime.IsZero() || avg > s.PeakWatts) {
+			log.WithFields(log.Fields{"watts": avg, "interval_start": s.IntervalStart}).Info("New peak demand for billing cycle")
+			s.PeakWatts = avg
+			s.PeakTime = end
+		}
+	}
+	s.IntervalJoules = 0
+	s.IntervalSeconds = 0
+}
+
+func (t *demandTracker) update(snap *Snapshot) {
+	site, ok := snap.Aggregates["site"]
+	if !ok {
+		return
+	}
+	sample := demandSample{time: snap.Time, watts: math.Max(float64(site.InstantPower), 0)}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &t.state
+	changed := false
+
+	if cycle := t.cycleStart(sample.time); !cycle.Equal(s.CycleStart) {
+		log.WithFields(log.Fields{"cycle_start": cycle}).Info("Starting new demand billing cycle")
+		s.CycleStart = cycle
+		s.PeakWatts = 0
+		s.PeakTime = time.Time{}
+		changed = true
+	}
+
+	// We assume power stays at whatever was last sampled until the next
+	// sample, but we don't try to bridge long gaps.
+	if t.last != nil && sample.time.Sub(t.last.time) > t.config.Interval {
+		t.last = nil
+	}
+	interval := t.intervalStart(sample.time)
+	if !interval.Equal(s.IntervalStart) {
+		if t.last != nil && t.last.time.Before(interval) {
+			// Credit the old interval with its share of the time
+			// since the last sample.
+			if t.intervalStart(t.last.time).Equal(s.IntervalStart) {
+				dt := interval.Sub(t.last.time).Seconds()
+				s.IntervalJoules += t.last.watts * dt
+				s.IntervalSeconds += dt
+			}
+			t.last = &demandSample{time: interval, watts: t.last.watts}
+		}
+		t.finishInterval()
+		s.IntervalStart = interval
+		changed = true
+	}
+	if t.last != nil {
+		dt := sample.time.Sub(t.last.time).Seconds()
+		s.IntervalJoules += t.last.watts * dt
+		s.IntervalSeconds += dt
+	}
+	t.last = &sample
+
+	t.samples = append(t.samples, sample)
+	start := sample.time.Add(-t.config.Interval)
+	for len(t.samples) > 1 && !t.samples[1].time.After(start) {
+		t.samples = t.samples[1:]
+	}
+
+	if changed || sample.time.Sub(t.saved) >= demandSaveInterval {
+		t.store.set(demandStateKey, s)
+		t.saved = sample.time
+	}
+}
+
+func (t *demandTracker) collect(c *powerwallCollector, ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &t.state
+	if s.CycleStart.IsZero() {
+		return
+	}
+	c.setGauge64(ch, "demand_cycle_start_timestamp_seconds", float64(s.CycleStart.Unix()))
+	if s.IntervalSeconds > 0 {
+		c.setGauge64(ch, "demand_interval_watts", s.IntervalJoules / s.IntervalSeconds)
+	}
+	if !s.PeakTime.IsZero() {
+		c.setGauge64(ch, "demand_peak_watts", s.PeakWatts)
+		c.setGauge64(ch, "demand_peak_timestamp_seconds", float64(s.PeakTime.Unix()))
+	}
+
+	// Time-weighted average of the samples in the rolling window
+	if len(t.samples) > 1 {
+		var joules, seconds float64
+		for i := 1; i < len(t.samples); i++ {
+			dt := t.samples[i].time.Sub(t.samples[i - 1].time).Seconds()
+			joules += t.samples[i - 1].watts * dt
+			seconds += dt
+		}
+		if seconds > 0 {
+			c.setGauge64(ch, "demand_rolling_watts", joules / seconds)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+)
+
+func TestDemandIntervals(t *testing.T) {
+	loc := setSiteTimezone(t, "America/Los_Angeles")
+	tests := []struct {
+		name string
+		interval time.Duration
+		resetDay int
+		time time.Time
+		wantInterval time.Time
+		wantCycle time.Time
+	}{
+		{"on boundary", 15 * time.Minute, 1, time.Date(2024, 5, 10, 13, 15, 0, 0, loc), time.Date(2024, 5, 10, 13, 15, 0, 0, loc), time.Date(2024, 5, 1, 0, 0, 0, 0, loc)},
+		{"mid interval", 15 * time.Minute, 1, time.Date(2024, 5, 10, 13, 29, 59, 0, loc), time.Date(2024, 5, 10, 13, 15, 0, 0, loc), time.Date(2024, 5, 1, 0, 0, 0, 0, loc)},
+		{"30 minutes", 30 * time.Minute, 1, time.Date(2024, 5, 10, 13, 29, 59, 0, loc), time.Date(2024, 5, 10, 13, 0, 0, 0, loc), time.Date(2024, 5, 1, 0, 0, 0, 0, loc)},
+		{"cycle start", 15 * time.Minute, 15, time.Date(2024, 5, 15, 0, 0, 0, 0, loc), time.Date(2024, 5, 15, 0, 0, 0, 0, loc), time.Date(2024, 5, 15, 0, 0, 0, 0, loc)},
+		{"before reset day", 15 * time.Minute, 15, time.Date(2024, 5, 14, 23, 59, 59, 0, loc), time.Date(2024, 5, 14, 23, 45, 0, 0, loc), time.Date(2024, 4, 15, 0, 0, 0, 0, loc)},
+		{"cycle over new year", 15 * time.Minute, 10, time.Date(2024, 1, 5, 12, 0, 0, 0, loc), time.Date(2024, 1, 5, 12, 0, 0, 0, loc), time.Date(2023, 12, 10, 0, 0, 0, 0, loc)},
+		// Boundaries are in the site timezone, not UTC
+		{"site timezone", 15 * time.Minute, 1, time.Date(2024, 6, 1, 6, 50, 0, 0, time.UTC), time.Date(2024, 5, 31, 23, 45, 0, 0, loc), time.Date(2024, 5, 1, 0, 0, 0, 0, loc)},
+		// 2024-11-03: clocks go back at 2am, so 01:00-02:00 happens twice
+		{"DST end first", time.Hour, 1, time.Date(2024, 11, 3, 8, 30, 0, 0, time.UTC), time.Date(2024, 11, 3, 8, 0, 0, 0, time.UTC), time.Date(2024, 11, 1, 0, 0, 0, 0, loc)},
+		{"DST end second", time.Hour, 1, time.Date(2024, 11, 3, 9, 30, 0, 0, time.UTC), time.Date(2024, 11, 3, 9, 0, 0, 0, time.UTC), time.Date(2024, 11, 1, 0, 0, 0, 0, loc)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &demandTracker{config: &DemandConfig{Interval: tt.interval, ResetDay: tt.resetDay}}
+			if got := d.intervalStart(tt.time); !got.Equal(tt.wantInterval) {
+				t.Errorf("intervalStart(%s) = %s, want %s", tt.time.In(loc), got, tt.wantInterval)
+			}
+			if got := d.cycleStart(tt.time); !got.Equal(tt.wantCycle) {
+				t.Errorf("cycleStart(%s) = %s, want %s", tt.time.In(loc), got, tt.wantCycle)
+			}
+		})
+	}
+}
+
+func TestDemandTracker(t *testing.T) {
+	setSiteTimezone(t, "UTC")
+	// Samples are every five minutes from start, which is 45 minutes
+	// before a new billing cycle starts.
+	start := time.Date(2024, 2, 29, 23, 15, 0, 0, time.UTC)
+	cycle := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		watts []float64
+		wantPeak float64
+		wantPeakTime time.Time
+	}{
+		{
+			name: "within cycle",
+			watts: []float64{0, 0, 0, 0, 0, 0, 0, 0, 0, 1000, 1000, 1000, 0, 0, 0, 0},
+			wantPeak: 1000,
+			wantPeakTime: cycle.Add(15 * time.Minute),
+		},
+		{
+			name: "partial interval",
+			watts: []float64{0, 0, 0, 0, 0, 0, 0, 0, 0, 3000, 0, 0, 0, 0, 0, 0},
+			wantPeak: 1000,
+			wantPeakTime: cycle.Add(15 * time.Minute),
+		},
+		{
+			// The old cycle's last interval mustn't count
+			// towards the new cycle's peak.
+			name: "old cycle higher",
+			watts: []float64{0, 0, 0, 5000, 5000, 5000, 5000, 5000, 5000, 500, 500, 500, 0, 0, 0, 0},
+			wantPeak: 500,
+			wantPeakTime: cycle.Add(15 * time.Minute),
+		},
+		{
+			name: "negative is export",
+			watts: []float64{0, 0, 0, 0, 0, 0, 0, 0, 0, -2000, -2000, -2000, 600, 600, 600, 0},
+			wantPeak: 600,
+			wantPeakTime: cycle.Add(30 * time.Minute),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := &DemandConfig{ResetDay: 1}
+			setDemandDefaults(dc)
+			tracker := newDemandTracker(newTestCollector(t), dc, loadStateStore(""))
+			for i, w := range tt.watts {
+				tracker.update(&Snapshot{
+					Time: start.Add(time.Duration(i) * 5 * time.Minute),
+					Aggregates: map[string]powerwall.MeterAggregatesData{"site": {InstantPower: float32(w)}},
+				})
+			}
+			s := tracker.state
+			if !s.CycleStart.Equal(cycle) {
+				t.Errorf("cycle start = %s, want %s", s.CycleStart, cycle)
+			}
+			if math.Abs(s.PeakWatts - tt.wantPeak) > 1e-9 || !s.PeakTime.Equal(tt.wantPeakTime) {
+				t.Errorf("peak = %g at %s, want %g at %s", s.PeakWatts, s.PeakTime, tt.wantPeak, tt.wantPeakTime)
+			}
+		})
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type DerivedMetricConfig struct {
+	Name string `yaml:"name"`
+	Help string `yaml:"help"`
+	Expr string `yaml:"expr"`
+	expr exprNode
+}
+
+func setDerivedMetricDefaults(c *DerivedMetricConfig) {
+	if c.Help == "" {
+		c.Help = "Derived metric: " + c.Expr
+	}
+}
+
+func checkDerivedMetricConfig(c *DerivedMetricConfig) {
+	if c.Name == "" {
+		log.Fatal("Required parameter name not specified for entry in derived_metrics")
+	}
+	if !metricNameRE.MatchString(c.Name) {
+		log.Fatalf("Invalid metric name %q in derived_metrics", c.Name)
+	}
+	if c.Expr == "" {
+		log.Fatalf("Required parameter expr not specified for derived_metrics entry %q", c.Name)
+	}
+	var err error
+	c.expr, err = parseExpr(c.Expr)
+	if err != nil {
+		log.Fatalf("Invalid expr for derived_metrics entry %q: %s", c.Name, err)
+	}
+}
+
+// An exprSample is one value in an expression result, along with its labels.
+type exprSample struct {
+	labels map[string]string
+	value float64
+}
+
+// exprVector is the result of evaluating an expression: one sample for each
+// distinct set of labels.  A single sample with no labels (such as a
+// constant) acts as a scalar, and is combined with every sample on the other
+// side of an operator.
+type exprVector []exprSample
+
+func (v exprVector) isScalar() bool {
+	return len(v) == 1 && len(v[0].labels) == 0
+}
+
+func labelKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + "=" + strconv.Quote(labels[name])
+	}
+	return strings.Join(parts, ",")
+}
+
+// combine applies op to each pair of matching samples from a and b.  Samples
+// match if they have exactly the same labels (or one side is a scalar).
+func combine(a, b exprVector, op func(x, y float64) float64) exprVector {
+	result := exprVector{}
+	switch {
+	case a.isScalar():
+		for _, s := range b {
+			result = append(result, exprSample{labels: s.labels, value: op(a[0].value, s.value)})
+		}
+	case b.isScalar():
+		for _, s := range a {
+			result = append(result, exprSample{labels: s.labels, value: op(s.value, b[0].value)})
+		}
+	default:
+		index := make(map[string]exprSample)
+		for _, s := range b {
+			index[labelKey(s.labels)] = s
+		}
+		for _, s := range a {
+			if other, ok := index[labelKey(s.labels)]; ok {
+				result = append(result, exprSample{labels: s.labels, value: op(s.value, other.value)})
+			}
+		}
+	}
+	return result
+}
+
+// An exprEnv provides the metric values an expression is evaluated against,
+// keyed by metric name (without the exporter prefix).
+type exprEnv map[string]*dto.MetricFamily
+
+type exprNode interface {
+	eval(env exprEnv) exprVector
+}
+
+type exprNumber float64
+
+func (n exprNumber) eval(env exprEnv) exprVector {
+	return exprVector{{labels: map[string]string{}, value: float64(n)}}
+}
+
+type exprMatcher struct {
+	label string
+	value string
+	negate bool
+}
+
+// An exprSelector picks out the values of a metric, optionally only those
+// with particular labels.  Labels which are matched exactly are dropped from
+// the result, since they are the same for every sample (which means
+// `instant_power_watts{category="load"}` can be used like a plain number).
+type exprSelector struct {
+	metric string
+	matchers []exprMatcher
+}
+
+func (s *exprSelector) eval(env exprEnv) exprVector {
+	result := exprVector{}
+	mf := env[s.metric]
+	if mf == nil {
+		return result
+	}
+	for _, m := range mf.Metric {
+		labels := make(map[string]string)
+		for _, lp := range m.Label {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		matched := true
+		for _, matcher := range s.matchers {
+			if (labels[matcher.label] == matcher.value) == matcher.negate {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		for _, matcher := range s.matchers {
+			if !matcher.negate {
+				delete(labels, matcher.label)
+			}
+		}
+		var value float64
+		switch {
+		case m.Gauge != nil:
+			value = m.Gauge.GetValue()
+		case m.Counter != nil:
+			value = m.Counter.GetValue()
+		case m.Untyped != nil:
+			value = m.Untyped.GetValue()
+		default:
+			continue
+		}
+		result = append(result, exprSample{labels: labels, value: value})
+	}
+	return result
+}
+
+type exprBinary struct {
+	op byte
+	left, right exprNode
+}
+
+func (b *exprBinary) eval(env exprEnv) exprVector {
+	return combine(b.left.eval(env), b.right.eval(env), func(x, y float64) float64 {
+		switch b.op {
+		case '+':
+			return x + y
+		case '-':
+			return x - y
+		case '*':
+			return x * y
+		default:
+			return x / y
+		}
+	})
+}
+
+type exprNegate struct {
+	arg exprNode
+}
+
+func (n *exprNegate) eval(env exprEnv) exprVector {
+	return apply(n.arg.eval(env), func(x float64) float64 { return -x })
+}
+
+// apply returns the result of f on each sample of v.
+func apply(v exprVector, f func(x float64) float64) exprVector {
+	result := exprVector{}
+	for _, s := range v {
+		result = append(result, exprSample{labels: s.labels, value: f(s.value)})
+	}
+	return result
+}
+
+// exprFuncs are the functions which can be used in expressions, with the
+// number of arguments each one takes.
+var exprFuncs = map[string]int{
+	"abs": 1,
+	"min": 2,
+	"max": 2,
+	"clamp": 3,
+}
+
+type exprCall struct {
+	name string
+	args []exprNode
+}
+
+func (c *exprCall) eval(env exprEnv) exprVector {
+	args := make([]exprVector, len(c.args))
+	for i, arg := range c.args {
+		args[i] = arg.eval(env)
+	}
+	switch c.name {
+	case "abs":
+		return apply(args[0], math.Abs)
+	case "min":
+		return combine(args[0], args[1], math.Min)
+	case "max":
+		return combine(args[0], args[1], math.Max)
+	default:
+		// clamp(x, lo, hi)
+		return combine(combine(args[0], args[1], math.Max), args[2], math.Min)
+	}
+}
+
+// exprParser is a simple recursive-descent parser for derived metric
+// expressions.  The grammar is:
+//
+//   expr    = term { ("+" | "-") term }
+//   term    = unary { ("*" | "/") unary }
+//   unary   = "-" unary | primary
+//   primary = number | "(" expr ")" | func "(" expr { "," expr } ")"
+//           | metric [ "{" label ("=" | "!=") string { "," ... } "}" ]
+type exprParser struct {
+	text string
+	pos int
+}
+
+func parseExpr(text string) (exprNode, error) {
+	p := &exprParser{text: text}
+	node, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.text) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.text[p.pos:], p.pos + 1)
+	}
+	return node, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.text) && unicode.IsSpace(rune(p.text[p.pos])) {
+		p.pos++
+	}
+}
+
+// peek returns the next non-space character, or 0 at the end of the text.
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.text) {
+		return 0
+	}
+	return p.text[p.pos]
+}
+
+func (p *exprParser) expect(ch byte) error {
+	if p.peek() != ch {
+		if p.pos >= len(p.text) {
+			return fmt.Errorf("expected %q at end of expression", ch)
+		}
+		return fmt.Errorf("expected %q at position %d", ch, p.pos + 1)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	left, err := p.parseTerm()
+	for err == nil {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			break
+		}
+		p.pos++
+		var right exprNode
+		right, err = p.parseTerm()
+		left = &exprBinary{op: op, left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseTerm() (exprNode, error) {
+	left, err := p.parseUnary()
+	for err == nil {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			break
+		}
+		p.pos++
+		var right exprNode
+		right, err = p.parseUnary()
+		left = &exprBinary{op: op, left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.peek() == '-' {
+		p.pos++
+		arg, err := p.parseUnary()
+		return &exprNegate{arg: arg}, err
+	}
+	return p.parsePrimary()
+}
+
+func isIdentChar(ch byte, first bool) bool {
+	return ch == '_' || ch == ':' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (!first && ch >= '0' && ch <= '9')
+}
+
+func (p *exprParser) parseIdent() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.text) && isIdentChar(p.text[p.pos], p.pos == start) {
+		p.pos++
+	}
+	return p.text[start:p.pos]
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	ch := p.peek()
+	switch {
+	case ch == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case ch == '(':
+		p.pos++
+		node, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(')')
+	case ch == '.' || (ch >= '0' && ch <= '9'):
+		start := p.pos
+		for p.pos < len(p.text) && strings.IndexByte("0123456789.eE", p.text[p.pos]) >= 0 {
+			// Allow a sign straight after an exponent
+			if (p.text[p.pos] == 'e' || p.text[p.pos] == 'E') && p.pos + 1 < len(p.text) && (p.text[p.pos + 1] == '-' || p.text[p.pos + 1] == '+') {
+				p.pos++
+			}
+			p.pos++
+		}
+		n, err := strconv.ParseFloat(p.text[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", p.text[start:p.pos], start + 1)
+		}
+		return exprNumber(n), nil
+	case isIdentChar(ch, true):
+		start := p.pos
+		name := p.parseIdent()
+		if nargs, ok := exprFuncs[name]; ok && p.peek() == '(' {
+			p.pos++
+			call := &exprCall{name: name}
+			for i := 0; i < nargs; i++ {
+				if i > 0 {
+					if err := p.expect(','); err != nil {
+						return nil, err
+					}
+				}
+				arg, err := p.parseSum()
+				if err != nil {
+					return nil, err
+				}
+				call.args = append(call.args, arg)
+			}
+			return call, p.expect(')')
+		}
+		if p.peek() == '(' {
+			return nil, fmt.Errorf("unknown function %q at position %d", name, start + 1)
+		}
+		sel := &exprSelector{metric: name}
+		if p.peek() == '{' {
+			p.pos++
+			for p.peek() != '}' {
+				if len(sel.matchers) > 0 {
+					if err := p.expect(','); err != nil {
+						return nil, err
+					}
+				}
+				m, err := p.parseMatcher()
+				if err != nil {
+					return nil, err
+				}
+				sel.matchers = append(sel.matchers, m)
+			}
+			p.pos++
+		}
+		return sel, nil
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", ch, p.pos + 1)
+}
+
+func (p *exprParser) parseMatcher() (exprMatcher, error) {
+	m := exprMatcher{label: p.parseIdent()}
+	if m.label == "" {
+		return m, fmt.Errorf("expected label name at position %d", p.pos + 1)
+	}
+	if p.peek() == '!' {
+		p.pos++
+		m.negate = true
+	}
+	if err := p.expect('='); err != nil {
+		return m, err
+	}
+	if p.peek() != '"' {
+		return m, fmt.Errorf("expected quoted string at position %d", p.pos + 1)
+	}
+	end := p.pos + 1
+	for end < len(p.text) && p.text[end] != '"' {
+		if p.text[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(p.text) {
+		return m, fmt.Errorf("unterminated string at position %d", p.pos + 1)
+	}
+	value, err := strconv.Unquote(p.text[p.pos:end + 1])
+	if err != nil {
+		return m, fmt.Errorf("invalid string at position %d", p.pos + 1)
+	}
+	m.value = value
+	p.pos = end + 1
+	return m, nil
+}
+
+// A derivedGatherer adds derived metrics to those gathered from another
+// Gatherer (normally the main registry).  Each derived metric can use the
+// values of any metric before it, including other derived ones.
+type derivedGatherer struct {
+	gatherer prometheus.Gatherer
+	metrics []DerivedMetricConfig
+}
+
+func newDerivedGatherer(c *powerwallCollector, g prometheus.Gatherer, metrics []DerivedMetricConfig) *derivedGatherer {
+	seen := make(map[string]bool)
+	for _, dm := range metrics {
+		if _, ok := c.metrics[dm.Name]; ok || seen[dm.Name] {
+			log.Fatalf("derived_metrics entry %q has the same name as an existing metric", dm.Name)
+		}
+		seen[dm.Name] = true
+	}
+	return &derivedGatherer{gatherer: g, metrics: metrics}
+}
+
+func (d *derivedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := d.gatherer.Gather()
+	env := make(exprEnv)
+	for _, mf := range families {
+		env[strings.TrimPrefix(mf.GetName(), exporterName + "_")] = mf
+	}
+	for _, dm := range d.metrics {
+		name := exporterName + "_" + dm.Name
+		help := dm.Help
+		mf := &dto.MetricFamily{
+			Name: &name,
+			Help: &help,
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+		for _, s := range dm.expr.eval(env) {
+			if math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+				// Probably a division by zero.
+				continue
+			}
+			value := s.value
+			m := &dto.Metric{Gauge: &dto.Gauge{Value: &value}}
+			for name, value := range s.labels {
+				name, value := name, value
+				m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &value})
+			}
+			sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+			mf.Metric = append(mf.Metric, m)
+		}
+		env[dm.Name] = mf
+		if len(mf.Metric) > 0 {
+			families = append(families, mf)
+		}
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	return families, err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// testGaugeFamily makes a gauge metric family with one metric for each of
+// values, each with a single label (or none if label is "").
+func testGaugeFamily(label string, values map[string]float64) *dto.MetricFamily {
+	mf := &dto.MetricFamily{}
+	for lv, v := range values {
+		v := v
+		m := &dto.Metric{Gauge: &dto.Gauge{Value: &v}}
+		if label != "" {
+			name, value := label, lv
+			m.Label = []*dto.LabelPair{{Name: &name, Value: &value}}
+		}
+		mf.Metric = append(mf.Metric, m)
+	}
+	return mf
+}
+
+// exprResult turns an expression result into a map of label key to value.
+func exprResult(v exprVector) map[string]float64 {
+	result := make(map[string]float64)
+	for _, s := range v {
+		result[labelKey(s.labels)] = s.value
+	}
+	return result
+}
+
+func TestParseExpr(t *testing.T) {
+	env := exprEnv{
+		"power": testGaugeFamily("category", map[string]float64{"load": 1000, "solar": 3000, "battery": -500}),
+		"other_power": testGaugeFamily("category", map[string]float64{"load": 10, "site": 20}),
+		"percentage": testGaugeFamily("", map[string]float64{"": 50}),
+	}
+	tests := []struct {
+		expr string
+		want map[string]float64
+	}{
+		{"1 + 2 * 3", map[string]float64{"": 7}},
+		{"(1 + 2) * 3", map[string]float64{"": 9}},
+		{"10 - 4 - 3", map[string]float64{"": 3}},
+		{"24 / 4 / 2", map[string]float64{"": 3}},
+		{"2 * -3", map[string]float64{"": -6}},
+		{"--2", map[string]float64{"": 2}},
+		{"1.5e3 + 1e-1", map[string]float64{"": 1500.1}},
+		{"  abs( -2 )  ", map[string]float64{"": 2}},
+		{"clamp(150, 0, 100)", map[string]float64{"": 100}},
+		{"min(1, 2) + max(1, 2)", map[string]float64{"": 3}},
+		{"percentage / 100", map[string]float64{"": 0.5}},
+		{`power{category="load"}`, map[string]float64{"": 1000}},
+		{`power{category="solar"} - power{category="load"}`, map[string]float64{"": 2000}},
+		{`power{category!="load"} / 1000`, map[string]float64{`category="battery"`: -0.5, `category="solar"`: 3}},
+		{"power * 2", map[string]float64{`category="load"`: 2000, `category="solar"`: 6000, `category="battery"`: -1000}},
+		// Only samples with matching labels on both sides are combined
+		{"power + other_power", map[string]float64{`category="load"`: 1010}},
+		{"max(power, 0)", map[string]float64{`category="load"`: 1000, `category="solar"`: 3000, `category="battery"`: 0}},
+		{"missing + 1", map[string]float64{}},
+		{`power{category="nothing"}`, map[string]float64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			node, err := parseExpr(tt.expr)
+			if err != nil {
+				t.Fatalf("parseExpr(%q): %s", tt.expr, err)
+			}
+			got := exprResult(node.eval(env))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if math.Abs(got[k] - v) > 1e-9 {
+					t.Errorf("got %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"", "unexpected end of expression"},
+		{"1 +", "unexpected end of expression"},
+		{"(1 + 2", `expected ')' at end of expression`},
+		{"1 2", `unexpected "2" at position 3`},
+		{"1 + )", `unexpected ')' at position 5`},
+		{"1.2.3", `invalid number "1.2.3" at position 1`},
+		{"sqrt(4)", `unknown function "sqrt" at position 1`},
+		{"min(1)", `expected ',' at position 6`},
+		{"abs(1, 2)", `expected ')' at position 6`},
+		{"power{category}", `expected '=' at position 15`},
+		{`power{category=load}`, "expected quoted string at position 16"},
+		{`power{category="load}`, "unterminated string at position 16"},
+		{`power{="load"}`, "expected label name at position 7"},
+		{`power{a="1" b="2"}`, `expected ',' at position 13`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := parseExpr(tt.expr)
+			if err == nil {
+				t.Fatalf("parseExpr(%q) succeeded, want error %q", tt.expr, tt.want)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("parseExpr(%q) error = %q, want %q", tt.expr, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCombine(t *testing.T) {
+	scalar := exprVector{{labels: map[string]string{}, value: 10}}
+	vec := func(values map[string]float64) exprVector {
+		v := exprVector{}
+		for cat, x := range values {
+			v = append(v, exprSample{labels: map[string]string{"category": cat}, value: x})
+		}
+		return v
+	}
+	sub := func(x, y float64) float64 { return x - y }
+	tests := []struct {
+		name string
+		a, b exprVector
+		want map[string]float64
+	}{
+		{"scalars", scalar, scalar, map[string]float64{"": 0}},
+		{"scalar left", scalar, vec(map[string]float64{"a": 1, "b": 2}), map[string]float64{`category="a"`: 9, `category="b"`: 8}},
+		{"scalar right", vec(map[string]float64{"a": 1, "b": 2}), scalar, map[string]float64{`category="a"`: -9, `category="b"`: -8}},
+		{"matching", vec(map[string]float64{"a": 5, "b": 6}), vec(map[string]float64{"b": 1, "a": 2}), map[string]float64{`category="a"`: 3, `category="b"`: 5}},
+		{"partial", vec(map[string]float64{"a": 5, "b": 6}), vec(map[string]float64{"b": 1, "c": 2}), map[string]float64{`category="b"`: 5}},
+		{"empty", vec(map[string]float64{"a": 5}), exprVector{}, map[string]float64{}},
+		{"different labels", vec(map[string]float64{"a": 5}), exprVector{{labels: map[string]string{"phase": "a"}, value: 1}}, map[string]float64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exprResult(combine(tt.a, tt.b, sub)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
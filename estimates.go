@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultEstimatesWindow = "5m"
+
+// If the (smoothed) battery power is less than this, we consider the battery
+// to be idle, and don't try to estimate how long it will take to charge or
+// discharge (the answer would be "practically forever" anyway).
+const estimateIdleWatts = 10
+
+type EstimatesConfig struct {
+	Window time.Duration `yaml:"window"`
+}
+
+func checkEstimatesConfig(c *EstimatesConfig) {
+	if c.Window <= 0 {
+		log.Fatal("estimates.window must be greater than zero")
+	}
+}
+
+type powerSample struct {
+	time time.Time
+	battery float64
+	load float64
+}
+
+// estimateTracker estimates how long the batteries will take to reach the
+// backup reserve, run out, or fill up at the current rate of charge or
+// discharge, and how long they could run the home if the grid went down.
+// Power values are averaged over a window, so the estimates don't jump
+// around too much whenever something turns on or off.
+type estimateTracker struct {
+	config *EstimatesConfig
+	mu sync.Mutex
+	samples []powerSample
+	remaining float64
+	full float64
+	reserve float64
+	haveEnergy bool
+	haveReserve bool
+}
+
+func newEstimateTracker(c *powerwallCollector, ec *EstimatesConfig) *estimateTracker {
+	c.newDesc("time_to_reserve_seconds", "Estimated time until the batteries discharge to the backup reserve at the current rate", nil)
+	c.newDesc("time_to_empty_seconds", "Estimated time until the batteries are completely discharged at the current rate", nil)
+	c.newDesc("time_to_full_seconds", "Estimated time until the batteries are fully charged at the current rate", nil)
+	c.newDesc("backup_runtime_seconds", "Estimated time the batteries could power the home at the current load if the grid went down", nil)
+	return &estimateTracker{config: ec}
+}
+
+func (t *estimateTracker) update(snap *Snapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.haveEnergy = snap.SystemStatus != nil
+	if t.haveEnergy {
+		t.remaining = float64(snap.SystemStatus.NominalEnergyRemaining) * 3600
+		t.full = float64(snap.SystemStatus.NominalFullPackEnergy) * 3600
+	}
+	t.haveReserve = snap.Operation != nil
+	if t.haveReserve {
+		t.reserve = float64(snap.Operation.BackupReservePercent) / 100
+	}
+
+	battery, ok1 := snap.Aggregates["battery"]
+	load, ok2 := snap.Aggregates["load"]
+	if ok1 && ok2 {
+		t.samples = append(t.samples, powerSample{
+			time: snap.Time,
+			battery: float64(battery.InstantPower),
+			load: float64(load.InstantPower),
+		})
+	}
+	start := snap.Time.Add(-t.config.Window)
+	for len(t.samples) > 0 && t.samples[0].time.Before(start) {
+		t.samples = t.samples[1:]
+	}
+}
+
+func (t *estimateTracker) collect(c *powerwallCollector, ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.haveEnergy || len(t.samples) == 0 {
+		return
+	}
+	var battery, load float64
+	for _, s := range t.samples {
+		battery += s.battery
+		load += s.load
+	}
+	battery /= float64(len(t.samples))
+	load /= float64(len(t.samples))
+
+	if battery >= estimateIdleWatts {
+		c.setGauge64(ch, "time_to_empty_seconds", t.remaining / battery)
+		if t.haveReserve {
+			reserve := t.reserve * t.full
+			if t.remaining > reserve {
+				c.setGauge64(ch, "time_to_reserve_seconds", (t.remaining - reserve) / battery)
+			} else {
+				c.setGauge64(ch, "time_to_reserve_seconds", 0)
+			}
+		}
+	} else if battery <= -estimateIdleWatts && t.full > t.remaining {
+		c.setGauge64(ch, "time_to_full_seconds", (t.full - t.remaining) / -battery)
+	}
+	if load > 0 {
+		c.setGauge64(ch, "backup_runtime_seconds", t.remaining / load)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultEventsRetention = "8760h" // One year
+	defaultEventsMaxEvents = 10000
+
+	eventProblemActive = "active"
+	eventProblemCleared = "cleared"
+
+	// Once events have started expiring, the journal file is rewritten
+	// without them at most this often (so it may hold a few more than
+	// the limits allow for a little while).
+	eventsCompactInterval = time.Hour
+)
+
+type EventsConfig struct {
+	File string `yaml:"file"`
+	Retention time.Duration `yaml:"retention"`
+	MaxEvents int `yaml:"max_events"`
+}
+
+func setEventsDefaults(c *EventsConfig) {
+	if c.Retention == 0 {
+		c.Retention, _ = time.ParseDuration(defaultEventsRetention)
+	}
+	if c.MaxEvents == 0 {
+		c.MaxEvents = defaultEventsMaxEvents
+	}
+}
+
+func checkEventsConfig(c *EventsConfig) {
+	if c.File == "" {
+		log.Fatal("Required parameter events.file not specified in config file")
+	}
+	if c.Retention < 0 {
+		log.Fatal("events.retention must not be negative")
+	}
+	if c.MaxEvents < 1 {
+		log.Fatal("events.max_events must be at least 1")
+	}
+}
+
+// A journalEvent records a change in some part of the system's state.
+// Subject identifies which thing changed, for types where there can be more
+// than one (e.g. the network name for "network_state").
+type journalEvent struct {
+	Time time.Time `json:"timestamp"`
+	Type string `json:"type"`
+	Subject string `json:"subject,omitempty"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// An eventJournal watches each new snapshot for changes in state, and
+// appends a record of each one to a file (as JSON lines).  It also keeps all
+// of the events in memory (oldest first), so requests for them don't need to
+// read the file.
+type eventJournal struct {
+	config *EventsConfig
+	mu sync.Mutex
+	// The last known value of everything we're watching, keyed by
+	// "<type>/<subject>"
+	values map[string]string
+	events []journalEvent
+	// When the file was last rewritten to remove expired events
+	compacted time.Time
+}
+
+func newEventJournal(c *EventsConfig) *eventJournal {
+	j := &eventJournal{
+		config: c,
+		values: make(map[string]string),
+	}
+	// Pick up where we left off, so changes which happened while we
+	// weren't running still get recorded when we notice them.
+	events, err := readJournal(c.File)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Unable to read event journal: %s", err)
+	}
+	for _, ev := range events {
+		j.values[ev.Type + "/" + ev.Subject] = ev.New
+	}
+	j.events = events
+	log.WithFields(log.Fields{"file": c.File, "events": len(events)}).Info("Opened event journal")
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.expire(time.Now())
+	return j
+}
+
+// readJournal reads all of the events in a journal file.
+func readJournal(filename string) ([]journalEvent, error) {
+	events := []journalEvent{}
+	f, err := os.Open(filename)
+	if err != nil {
+		return events, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64 * 1024), 1024 * 1024)
+	for scanner.Scan() {
+		var ev journalEvent
+		if json.Unmarshal(scanner.Bytes(), &ev) != nil {
+			// Probably a partial line from a crash.  Skip it.
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events, scanner.Err()
+}
+
+// list returns the events at or after since, optionally only those of the
+// given types.
+func (j *eventJournal) list(since time.Time, types map[string]bool) []journalEvent {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// Events are always added in time order
+	start := sort.Search(len(j.events), func(i int) bool { return !j.events[i].Time.Before(since) })
+	events := []journalEvent{}
+	for _, ev := range j.events[start:] {
+		if types == nil || types[ev.Type] {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+// expire drops events which are older than the retention period, or beyond
+// the maximum number to keep, and rewrites the file without them (if it
+// hasn't done so too recently).  The caller must hold j.mu.
+func (j *eventJournal) expire(now time.Time) {
+	drop := len(j.events) - j.config.MaxEvents
+	if drop < 0 {
+		drop = 0
+	}
+	if j.config.Retention > 0 {
+		cutoff := now.Add(-j.config.Retention)
+		for drop < len(j.events) && j.events[drop].Time.Before(cutoff) {
+			drop++
+		}
+	}
+	if drop > 0 {
+		j.events = append([]journalEvent(nil), j.events[drop:]...)
+	}
+	if now.Sub(j.compacted) < eventsCompactInterval {
+		return
+	}
+	// The file may still have events we've already dropped from
+	// memory, so check that rather than what we just dropped.
+	n, err := countLines(j.config.File)
+	if err != nil || n <= len(j.events) {
+		return
+	}
+	j.compacted = now
+	err = j.rewrite()
+	if err != nil {
+		log.WithFields(log.Fields{"file": j.config.File, "err": err}).Error("Unable to remove expired events from event journal")
+		return
+	}
+	log.WithFields(log.Fields{"file": j.config.File, "removed": n - len(j.events)}).Debug("Removed expired events from event journal")
+}
+
+// countLines returns the number of lines in a file.
+func countLines(filename string) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n := 0
+	buf := make([]byte, 32 * 1024)
+	for {
+		c, err := f.Read(buf)
+		n += bytes.Count(buf[:c], []byte{'\n'})
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+	}
+}
+
+// rewrite replaces the journal file with just the events we're keeping.  Like
+// the state file, it writes to a temporary file first and then renames it.
+// The caller must hold j.mu.
+func (j *eventJournal) rewrite() error {
+	filename := j.config.File
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename) + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, ev := range j.events {
+		line, err := json.Marshal(ev)
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		w.Write(line)
+		w.WriteString("\n")
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// check compares a value against the last one we saw, and returns an event if
+// it has changed.  If we've never seen a value for it before, we just note it
+// (we don't know what it changed from, or when).
+func (j *eventJournal) check(ts time.Time, evtype, subject, value string) *journalEvent {
+	key := evtype + "/" + subject
+	old, ok := j.values[key]
+	j.values[key] = value
+	if !ok || old == value {
+		return nil
+	}
+	return &journalEvent{Time: ts, Type: evtype, Subject: subject, Old: old, New: value}
+}
+
+// update is registered as a collector listener.
+func (j *eventJournal) update(snap *Snapshot) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	events := []*journalEvent{}
+	add := func(evtype, subject, value string) {
+		if ev := j.check(snap.Time, evtype, subject, value); ev != nil {
+			events = append(events, ev)
+		}
+	}
+
+	if snap.Status != nil {
+		add("firmware_version", "", snap.Status.Version)
+	}
+	if snap.Operation != nil {
+		add("operation_mode", "", snap.Operation.RealMode)
+	}
+	if snap.SystemStatus != nil {
+		add("island_state", "", snap.SystemStatus.SystemIslandState)
+	}
+	if snap.Sitemaster != nil {
+		add("sitemaster_running", "", strconv.FormatBool(snap.Sitemaster.Running))
+		add("sitemaster_connected", "", strconv.FormatBool(snap.Sitemaster.ConnectedToTesla))
+	}
+	for _, net := range snap.Networks {
+		if net.IfaceNetworkInfo.NetworkName != "" {
+			add("network_state", net.NetworkName, net.IfaceNetworkInfo.State)
+		}
+	}
+	if snap.Problems != nil {
+		// Problems don't have any obvious identifier, so we use the
+		// whole thing (as JSON) as the subject.
+		current := make(map[string]bool)
+		for _, p := range snap.Problems.Problems {
+			text, err := json.Marshal(p)
+			if err != nil {
+				text = []byte(fmt.Sprintf("%v", p))
+			}
+			current[string(text)] = true
+		}
+		for key, value := range j.values {
+			subject := strings.TrimPrefix(key, "problem/")
+			if subject != key && value == eventProblemActive && !current[subject] {
+				events = append(events, &journalEvent{Time: snap.Time, Type: "problem", Subject: subject, Old: eventProblemActive, New: eventProblemCleared})
+				j.values[key] = eventProblemCleared
+			}
+		}
+		for subject := range current {
+			if j.values["problem/" + subject] != eventProblemActive {
+				// Unlike other things, a problem we've never
+				// seen before is news.
+				events = append(events, &journalEvent{Time: snap.Time, Type: "problem", Subject: subject, Old: eventProblemCleared, New: eventProblemActive})
+				j.values["problem/" + subject] = eventProblemActive
+			}
+		}
+	}
+
+	if len(events) == 0 {
+		return
+	}
+	sort.SliceStable(events, func(a, b int) bool { return events[a].Type < events[b].Type })
+	for _, ev := range events {
+		j.events = append(j.events, *ev)
+	}
+	err := j.append(events)
+	if err != nil {
+		log.WithFields(log.Fields{"file": j.config.File, "err": err}).Error("Unable to write to event journal")
+	}
+	j.expire(snap.Time)
+}
+
+// append writes events to the end of the journal.  The caller must hold j.mu.
+func (j *eventJournal) append(events []*journalEvent) error {
+	f, err := os.OpenFile(j.config.File, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, ev := range events {
+		log.WithFields(log.Fields{"type": ev.Type, "subject": ev.Subject, "old": ev.Old, "new": ev.New}).Info("State change")
+		line, err := json.Marshal(ev)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(line)
+		w.WriteString("\n")
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ServeHTTP returns events from the journal as a JSON array.  The "since"
+// parameter (RFC 3339 time, or Unix seconds) limits it to events at or after
+// that time, and "type" (comma-separated) to particular types of event.
+func (j *eventJournal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			secs, err2 := strconv.ParseFloat(v, 64)
+			if err2 != nil {
+				http.Error(w, "Invalid 'since' parameter (must be RFC 3339 time or Unix seconds)", http.StatusBadRequest)
+				return
+			}
+			whole, frac := math.Modf(secs)
+			since = time.Unix(int64(whole), int64(frac * 1e9))
+		}
+	}
+	var types map[string]bool
+	if v := r.URL.Query().Get("type"); v != "" {
+		types = make(map[string]bool)
+		for _, t := range strings.Split(v, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+	writeJSON(w, j.list(since, types))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+)
+
+// newTestJournal writes events to a new journal file, and opens it with the
+// given config (plus defaults).
+func newTestJournal(t *testing.T, c *EventsConfig, events []journalEvent) *eventJournal {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "events.json")
+	var lines []string
+	for _, ev := range events {
+		line, _ := json.Marshal(ev)
+		lines = append(lines, string(line) + "\n")
+	}
+	if err := os.WriteFile(filename, []byte(strings.Join(lines, "")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.File = filename
+	setEventsDefaults(c)
+	return newEventJournal(c)
+}
+
+func TestEventJournalUpdate(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	mode := func(m string) *Snapshot {
+		return &Snapshot{Operation: &powerwall.OperationData{RealMode: m}}
+	}
+	problems := func(p ...string) *Snapshot {
+		data := &powerwall.TroubleshootingProblemsData{Problems: []interface{}{}}
+		for _, s := range p {
+			data.Problems = append(data.Problems, s)
+		}
+		return &Snapshot{Problems: data}
+	}
+	tests := []struct {
+		name string
+		previous []journalEvent // already in the journal
+		snaps []*Snapshot
+		want []string // "<type> <old> -> <new>"
+	}{
+		{
+			name: "first value isn't an event",
+			snaps: []*Snapshot{mode("self_consumption")},
+		},
+		{
+			name: "change",
+			snaps: []*Snapshot{mode("self_consumption"), mode("self_consumption"), mode("backup"), mode("self_consumption")},
+			want: []string{"operation_mode self_consumption -> backup", "operation_mode backup -> self_consumption"},
+		},
+		{
+			name: "change while not running",
+			previous: []journalEvent{{Time: start.Add(-time.Hour), Type: "operation_mode", Old: "backup", New: "autonomous"}},
+			snaps: []*Snapshot{mode("self_consumption")},
+			want: []string{"operation_mode autonomous -> self_consumption"},
+		},
+		{
+			name: "problems",
+			snaps: []*Snapshot{problems(), problems("a"), problems("a", "b"), problems("b")},
+			want: []string{`problem cleared -> active`, `problem cleared -> active`, `problem active -> cleared`},
+		},
+		{
+			name: "problem still active after restart",
+			previous: []journalEvent{{Time: start.Add(-time.Hour), Type: "problem", Subject: `"a"`, Old: "cleared", New: "active"}},
+			snaps: []*Snapshot{problems("a"), problems()},
+			want: []string{`problem active -> cleared`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := newTestJournal(t, &EventsConfig{}, tt.previous)
+			for i, snap := range tt.snaps {
+				snap.Time = start.Add(time.Duration(i) * time.Minute)
+				j.update(snap)
+			}
+			w := httptest.NewRecorder()
+			j.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/events", nil))
+			var events []journalEvent
+			if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, ev := range events[len(tt.previous):] {
+				got = append(got, ev.Type + " " + ev.Old + " -> " + ev.New)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got events %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventJournalServeHTTP(t *testing.T) {
+	start := time.Now().Truncate(time.Second).Add(-time.Hour).UTC()
+	events := []journalEvent{}
+	for i, evtype := range []string{"grid_status", "alert", "grid_status", "operation_mode"} {
+		events = append(events, journalEvent{Time: start.Add(time.Duration(i) * time.Minute), Type: evtype, Old: "a", New: "b"})
+	}
+	j := newTestJournal(t, &EventsConfig{}, events)
+	tests := []struct {
+		name string
+		query string
+		want int // number of events, or -1 for a bad request
+	}{
+		{"all", "", 4},
+		{"since exact", "since=" + start.Add(time.Minute).Format(time.RFC3339), 3},
+		{"since between", "since=" + start.Add(90 * time.Second).Format(time.RFC3339), 2},
+		{"since unix seconds", "since=" + strconv.FormatInt(start.Add(time.Minute).Unix(), 10), 3},
+		{"since after", "since=" + start.Add(time.Hour).Format(time.RFC3339), 0},
+		{"type", "type=grid_status", 2},
+		{"types", "type=grid_status,%20alert", 3},
+		{"since and type", "type=grid_status&since=" + start.Add(time.Second).Format(time.RFC3339), 1},
+		{"bad since", "since=yesterday", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			j.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/events?" + tt.query, nil))
+			if tt.want < 0 {
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+				}
+				return
+			}
+			var got []journalEvent
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("status %d: %s", w.Code, err)
+			}
+			if len(got) != tt.want {
+				t.Errorf("got %d events, want %d", len(got), tt.want)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	j.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/events", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestEventJournalExpire(t *testing.T) {
+	// Old events are removed as soon as the journal is opened
+	now := time.Now()
+	tests := []struct {
+		name string
+		retention time.Duration
+		maxEvents int
+		ages []time.Duration // of each event, oldest first
+		want int // events kept
+	}{
+		{"nothing expired", 24 * time.Hour, 10, []time.Duration{3 * time.Hour, 2 * time.Hour, time.Hour}, 3},
+		{"retention", 24 * time.Hour, 10, []time.Duration{48 * time.Hour, 25 * time.Hour, time.Hour}, 1},
+		{"max events", 24 * time.Hour, 2, []time.Duration{3 * time.Hour, 2 * time.Hour, time.Hour}, 2},
+		{"long retention", 20000 * time.Hour, 10, []time.Duration{10000 * time.Hour, time.Hour}, 2},
+		{"all expired", time.Hour, 10, []time.Duration{3 * time.Hour, 2 * time.Hour}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := []journalEvent{}
+			for i, age := range tt.ages {
+				events = append(events, journalEvent{Time: now.Add(-age), Type: "grid_status", Old: "a", New: string(rune('b' + i))})
+			}
+			j := newTestJournal(t, &EventsConfig{Retention: tt.retention, MaxEvents: tt.maxEvents}, events)
+			if len(j.events) != tt.want {
+				t.Fatalf("kept %d events, want %d", len(j.events), tt.want)
+			}
+			if tt.want > 0 && j.events[tt.want - 1].New != string(rune('a' + len(tt.ages))) {
+				t.Errorf("newest event not kept: %+v", j.events)
+			}
+			onDisk, err := readJournal(j.config.File)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(onDisk) != tt.want {
+				t.Errorf("file has %d events, want %d", len(onDisk), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const firmwareStateKey = "firmware"
+
+// verifiedFirmwareVersions lists the gateway software releases which this
+// exporter (and go-powerwall) have been tested against.  Entries match any
+// version which starts with them (so "21.44" covers "21.44.1", etc).
+var verifiedFirmwareVersions = []string{
+	"21.39",
+	"21.44",
+}
+
+// firmwareVerified returns true if the given gateway software version (as
+// reported by the status API, e.g. "21.44.1 c58c2df3") is one we know works.
+func firmwareVerified(version string) bool {
+	fields := strings.Fields(version)
+	if len(fields) == 0 {
+		return false
+	}
+	for _, v := range verifiedFirmwareVersions {
+		if fields[0] == v || strings.HasPrefix(fields[0], v + ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// firmwareState is saved across restarts, so we can tell if the gateway was
+// upgraded while we weren't running.
+type firmwareState struct {
+	Version string `json:"version"`
+	GitHash string `json:"git_hash"`
+	PreviousVersion string `json:"previous_version"`
+	PreviousGitHash string `json:"previous_git_hash"`
+	ChangeTime time.Time `json:"change_time"`
+	Changes int `json:"changes"`
+}
+
+// firmwareTracker notices when the gateway's software has been updated
+// (which it does by itself, without warning).
+type firmwareTracker struct {
+	store *stateStore
+	mu sync.Mutex
+	state firmwareState
+	// The last version we checked against verifiedFirmwareVersions
+	checked string
+}
+
+func newFirmwareTracker(c *powerwallCollector, store *stateStore) *firmwareTracker {
+	c.newDesc("firmware_info", "Current and previous gateway software versions", []string{"version", "git_hash", "previous_version", "previous_git_hash"})
+	c.newDesc("firmware_changes_total", "Number of times the gateway software version has been seen to change", nil)
+	c.newDesc("firmware_change_timestamp_seconds", "Time the gateway software version was last seen to change", nil)
+	c.newDesc("firmware_verified", "Whether the gateway software version is one the exporter has been verified against", []string{"version"})
+	t := &firmwareTracker{store: store}
+	if store.get(firmwareStateKey, &t.state) {
+		log.WithFields(log.Fields{"version": t.state.Version}).Info("Restored firmware version state")
+	}
+	return t
+}
+
+func (t *firmwareTracker) update(snap *Snapshot) {
+	status := snap.Status
+	if status == nil || status.Version == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &t.state
+	if status.Version != t.checked {
+		t.checked = status.Version
+		if !firmwareVerified(status.Version) {
+			log.WithFields(log.Fields{"version": status.Version, "verified_versions": verifiedFirmwareVersions}).Warn("Gateway software version has not been verified to work with this exporter.  Some metrics may be missing or wrong.")
+		}
+	}
+	if status.Version == s.Version && status.GitHash == s.GitHash {
+		return
+	}
+	if s.Version != "" {
+		log.WithFields(log.Fields{
+			"previous_version": s.Version,
+			"previous_git_hash": s.GitHash,
+			"version": status.Version,
+			"git_hash": status.GitHash,
+		}).Warn("Gateway software version has changed")
+		s.PreviousVersion = s.Version
+		s.PreviousGitHash = s.GitHash
+		s.ChangeTime = snap.Time
+		s.Changes++
+	}
+	s.Version = status.Version
+	s.GitHash = status.GitHash
+	t.store.set(firmwareStateKey, s)
+}
+
+func (t *firmwareTracker) collect(c *powerwallCollector, ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &t.state
+	if s.Version == "" {
+		return
+	}
+	c.setGauge64(ch, "firmware_info", 1, s.Version, s.GitHash, s.PreviousVersion, s.PreviousGitHash)
+	c.setCounter64(ch, "firmware_changes_total", float64(s.Changes))
+	c.setGaugeBool(ch, "firmware_verified", firmwareVerified(s.Version), s.Version)
+	if !s.ChangeTime.IsZero() {
+		c.setGauge64(ch, "firmware_change_timestamp_seconds", float64(s.ChangeTime.Unix()))
+	}
+}
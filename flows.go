@@ -0,0 +1,133 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// If there is a gap longer than this between snapshots, we don't try to
+// integrate power over it (we have no idea what happened in between).
+const maxFlowIntegrationGap = 10 * time.Minute
+
+// An energyFlow is a single path power can take between two parts of the
+// system (e.g. solar to home).
+type energyFlow struct {
+	source string
+	destination string
+}
+
+var energyFlows = []energyFlow{
+	{"solar", "home"},
+	{"solar", "battery"},
+	{"solar", "grid"},
+	{"grid", "home"},
+	{"grid", "battery"},
+	{"battery", "home"},
+	{"battery", "grid"},
+}
+
+// flowTracker breaks the net power figures from the meter aggregates down
+// into the individual flows between solar, grid, battery and home (the way
+// the Tesla app shows them), and integrates them over time to get the total
+// energy which has taken each path.
+type flowTracker struct {
+	mu sync.Mutex
+	time time.Time
+	watts map[energyFlow]float64
+	joules map[energyFlow]float64
+}
+
+func newFlowTracker(c *powerwallCollector) *flowTracker {
+	c.newDesc("energy_flow_watts", "Current power flowing from one part of the system to another", []string{"source", "destination"})
+	c.newDesc("energy_flow_joules_total", "Total energy which has flowed from one part of the system to another since the exporter started", []string{"source", "destination"})
+	return &flowTracker{
+		joules: make(map[energyFlow]float64),
+	}
+}
+
+// splitFlows works out the individual flows from the net power of each
+// category.  The meters can't actually tell us where each watt came from, so
+// we assume (as Tesla does) that solar goes to the home first, then to the
+// battery, then to the grid, and that the battery supplies the home before
+// exporting to the grid.
+func splitFlows(solar, grid, battery, load float64) map[energyFlow]float64 {
+	solar = math.Max(solar, 0)
+	load = math.Max(load, 0)
+	imported := math.Max(grid, 0)
+	exported := math.Max(-grid, 0)
+	charging := math.Max(-battery, 0)
+	discharging := math.Max(battery, 0)
+
+	f := make(map[energyFlow]float64)
+	f[energyFlow{"solar", "home"}] = math.Min(solar, load)
+	load -= f[energyFlow{"solar", "home"}]
+	solar -= f[energyFlow{"solar", "home"}]
+
+	f[energyFlow{"battery", "home"}] = math.Min(discharging, load)
+	load -= f[energyFlow{"battery", "home"}]
+	discharging -= f[energyFlow{"battery", "home"}]
+
+	f[energyFlow{"grid", "home"}] = math.Min(imported, load)
+	imported -= f[energyFlow{"grid", "home"}]
+
+	f[energyFlow{"solar", "battery"}] = math.Min(solar, charging)
+	solar -= f[energyFlow{"solar", "battery"}]
+	charging -= f[energyFlow{"solar", "battery"}]
+
+	f[energyFlow{"grid", "battery"}] = math.Min(imported, charging)
+
+	f[energyFlow{"solar", "grid"}] = math.Min(solar, exported)
+	exported -= f[energyFlow{"solar", "grid"}]
+
+	f[energyFlow{"battery", "grid"}] = math.Min(discharging, exported)
+	return f
+}
+
+func (t *flowTracker) update(snap *Snapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	power := map[string]float64{}
+	for _, cat := range []string{"solar", "site", "battery", "load"} {
+		data, ok := snap.Aggregates[cat]
+		if !ok {
+			// Without all of the pieces, we can't tell where
+			// anything is going.
+			t.watts = nil
+			return
+		}
+		power[cat] = float64(data.InstantPower)
+	}
+	watts := splitFlows(power["solar"], power["site"], power["battery"], power["load"])
+
+	// Integrate using the average of the power at the start and end of
+	// each interval.
+	if t.watts != nil {
+		dt := snap.Time.Sub(t.time)
+		if dt > 0 && dt <= maxFlowIntegrationGap {
+			for _, f := range energyFlows {
+				t.joules[f] += (t.watts[f] + watts[f]) / 2 * dt.Seconds()
+			}
+		}
+	}
+	t.time = snap.Time
+	t.watts = watts
+}
+
+func (t *flowTracker) collect(c *powerwallCollector, ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.time.IsZero() {
+		// We haven't seen any usable data yet
+		return
+	}
+	for _, f := range energyFlows {
+		if t.watts != nil {
+			c.setGauge64(ch, "energy_flow_watts", t.watts[f], f.source, f.destination)
+		}
+		c.setCounter64(ch, "energy_flow_joules_total", t.joules[f], f.source, f.destination)
+	}
+}
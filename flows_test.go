@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSplitFlows(t *testing.T) {
+	tests := []struct {
+		name string
+		solar, grid, battery, load float64
+		want map[energyFlow]float64 // anything not listed should be zero
+	}{
+		{
+			name: "idle",
+		},
+		{
+			name: "grid only",
+			grid: 1500, load: 1500,
+			want: map[energyFlow]float64{{"grid", "home"}: 1500},
+		},
+		{
+			name: "solar covers load and charges battery",
+			solar: 5000, battery: -3000, load: 2000,
+			want: map[energyFlow]float64{{"solar", "home"}: 2000, {"solar", "battery"}: 3000},
+		},
+		{
+			name: "solar surplus exported",
+			solar: 5000, grid: -1000, battery: -2000, load: 2000,
+			want: map[energyFlow]float64{{"solar", "home"}: 2000, {"solar", "battery"}: 2000, {"solar", "grid"}: 1000},
+		},
+		{
+			name: "battery and grid share the load",
+			solar: 500, grid: 1000, battery: 2000, load: 3500,
+			want: map[energyFlow]float64{{"solar", "home"}: 500, {"battery", "home"}: 2000, {"grid", "home"}: 1000},
+		},
+		{
+			name: "grid charges battery",
+			grid: 4000, battery: -3000, load: 1000,
+			want: map[energyFlow]float64{{"grid", "home"}: 1000, {"grid", "battery"}: 3000},
+		},
+		{
+			name: "solar and grid charge battery",
+			solar: 1000, grid: 2500, battery: -3000, load: 500,
+			want: map[energyFlow]float64{{"solar", "home"}: 500, {"solar", "battery"}: 500, {"grid", "battery"}: 2500},
+		},
+		{
+			name: "battery exports",
+			grid: -4000, battery: 5000, load: 1000,
+			want: map[energyFlow]float64{{"battery", "home"}: 1000, {"battery", "grid"}: 4000},
+		},
+		{
+			name: "solar and battery export",
+			solar: 2000, grid: -5000, battery: 4000, load: 1000,
+			want: map[energyFlow]float64{{"solar", "home"}: 1000, {"solar", "grid"}: 1000, {"battery", "grid"}: 4000},
+		},
+		{
+			// Solar inverters draw a little at night, and the load
+			// can read slightly negative.  Neither should produce
+			// negative flows.
+			name: "negative readings",
+			solar: -10, grid: 490, battery: 0, load: -5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitFlows(tt.solar, tt.grid, tt.battery, tt.load)
+			for _, f := range energyFlows {
+				if math.Abs(got[f] - tt.want[f]) > 1e-9 {
+					t.Errorf("%s -> %s = %g, want %g", f.source, f.destination, got[f], tt.want[f])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"github.com/foogod/go-powerwall"
+)
+
+// A gatewayClient makes raw API requests to the gateway, for cases where we
+// need the original response instead of what go-powerwall decodes it into.
+// It shares the auth token of the main powerwall client, so it doesn't need
+// to log in separately (and if it needs to log in again, the main client
+// benefits too).
+type gatewayClient struct {
+	pw *powerwall.Client
+	address string
+	http http.Client
+}
+
+func newGatewayClient(pw *powerwall.Client) *gatewayClient {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		// The gateway requires the SNI hostname to match its cert (see
+		// go-powerwall's NewClient for details).
+		ServerName: "powerwall",
+	}
+	if config.Device.cert != nil {
+		certPool := x509.NewCertPool()
+		certPool.AddCert(config.Device.cert)
+		tlsConfig.InsecureSkipVerify = false
+		tlsConfig.RootCAs = certPool
+	}
+	return &gatewayClient{
+		pw: pw,
+		address: config.Device.GatewayAddress,
+		http: http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// get fetches the given API path (e.g. "meters/aggregates", optionally with a
+// query string) from the gateway and returns the raw response body and
+// content type.  Failures are reported using the same error types as
+// go-powerwall (powerwall.ApiError, powerwall.AuthFailure, or a net.Error).
+// Like go-powerwall, it logs in first if we haven't yet, and logs each
+// request at debug level.  Log messages, logins, and the request details are
+// all recorded against the span in ctx (the same way traceClientLog does for
+// go-powerwall's calls).
+func (g *gatewayClient) get(ctx context.Context, api string) ([]byte, string, error) {
+	u := url.URL{
+		Scheme: "https",
+		Host: g.address,
+		Path: "api/" + api,
+	}
+	if i := strings.Index(api, "?"); i >= 0 {
+		u.Path = "api/" + api[:i]
+		u.RawQuery = api[i+1:]
+	}
+	logger := log.WithFields(traceLogFields(ctx))
+	span := trace.SpanFromContext(ctx)
+
+	token := g.pw.GetAuthToken()
+	if token == "" {
+		err := g.login(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		token = g.pw.GetAuthToken()
+	}
+
+	logger.Debugf("Calling API: method=%s url=%s", http.MethodGet, u.String())
+	span.SetAttributes(semconv.HTTPRequestMethodKey.String(http.MethodGet), semconv.URLFull(u.String()))
+	span.AddEvent("request")
+	resp, err := g.do(ctx, &u, token)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		// Our token has expired.  Have the main client log in
+		// again, and then retry with the new one.
+		resp.Body.Close()
+		msg := fmt.Sprintf("API request returned status %d.  Attempting re-auth...", resp.StatusCode)
+		logger.Debug(msg)
+		span.AddEvent("re-auth", trace.WithAttributes(attribute.String("message", msg)))
+		err = g.login(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		resp, err = g.do(ctx, &u, g.pw.GetAuthToken())
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		logger.Debugf("Request failed: status=%d", resp.StatusCode)
+		return nil, "", powerwall.AuthFailure{URL: u, ErrorText: resp.Status}
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		logger.Debugf("Request failed: status=%d body=%s", resp.StatusCode, body)
+		return body, "", powerwall.ApiError{URL: u, StatusCode: resp.StatusCode, Body: body}
+	}
+	logger.Debugf("Request succeeded: status=%d (%d bytes)", resp.StatusCode, len(body))
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+// login has the main client log in to the gateway, with its log messages (and
+// the login span) attributed to the span in ctx.
+func (g *gatewayClient) login(ctx context.Context) error {
+	beginClientCall(ctx)
+	defer endClientCall()
+	return g.pw.DoLogin()
+}
+
+// do performs a single GET request, retrying on network errors according to
+// the device retry settings (the same way go-powerwall does).  It gives up as
+// soon as ctx is cancelled (e.g. when a proxy client disconnects).
+func (g *gatewayClient) do(ctx context.Context, u *url.URL, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.AddCookie(&http.Cookie{Name: "AuthCookie", Value: token})
+	}
+
+	start := time.Now()
+	for {
+		attempt := time.Now()
+		resp, err := g.http.Do(req)
+		// A cancelled request also shows up as a net.Error, so check
+		// the context first rather than retrying it.
+		if ctx.Err() != nil {
+			return resp, err
+		}
+		if _, ok := err.(net.Error); !ok || time.Since(start) >= config.Device.RetryTimeout {
+			return resp, err
+		}
+		msg := fmt.Sprintf("Network error fetching API.  Retrying... (err=%s)", err)
+		log.WithFields(traceLogFields(ctx)).WithFields(log.Fields{"url": u.String()}).Debug(msg)
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(attribute.String("message", msg)))
+		timer := time.NewTimer(config.Device.RetryInterval - time.Since(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
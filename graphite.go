@@ -0,0 +1,227 @@
+package main
+
+import (
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	defaultGraphiteProtocol = graphiteProtocolGraphite
+	defaultGraphiteInterval = "60s"
+	defaultGraphitePathTemplate = "powerwall.<metric>.<labels>"
+
+	graphiteProtocolGraphite = "graphite"
+	graphiteProtocolStatsD = "statsd"
+)
+
+type GraphiteConfig struct {
+	Address string `yaml:"address"`
+	Protocol string `yaml:"protocol"`
+	Transport string `yaml:"transport"`
+	Interval time.Duration `yaml:"interval"`
+	PathTemplate string `yaml:"path_template"`
+	Tags map[string]string `yaml:"tags"`
+}
+
+func setGraphiteDefaults(c *GraphiteConfig) {
+	if c.Protocol == "" {
+		c.Protocol = defaultGraphiteProtocol
+	}
+	if c.Transport == "" {
+		// Graphite's plaintext protocol is usually spoken over TCP,
+		// while StatsD is almost always UDP.
+		if c.Protocol == graphiteProtocolStatsD {
+			c.Transport = "udp"
+		} else {
+			c.Transport = "tcp"
+		}
+	}
+	if c.Interval == 0 {
+		c.Interval, _ = time.ParseDuration(defaultGraphiteInterval)
+	}
+	if c.PathTemplate == "" {
+		c.PathTemplate = defaultGraphitePathTemplate
+	}
+}
+
+func checkGraphiteConfig(c *GraphiteConfig) {
+	if c.Address == "" {
+		log.Fatal("Required parameter graphite.address not specified in config file")
+	}
+	if c.Protocol != graphiteProtocolGraphite && c.Protocol != graphiteProtocolStatsD {
+		log.Fatalf("Invalid graphite.protocol %q (must be %q or %q)", c.Protocol, graphiteProtocolGraphite, graphiteProtocolStatsD)
+	}
+	if c.Transport != "tcp" && c.Transport != "udp" {
+		log.Fatalf("Invalid graphite.transport %q (must be \"tcp\" or \"udp\")", c.Transport)
+	}
+}
+
+// startGraphiteSink starts a background goroutine which periodically sends
+// all collected metrics to a Graphite (plaintext protocol) or StatsD server.
+func startGraphiteSink(g prometheus.Gatherer, c *GraphiteConfig) {
+	tmpl := newGraphitePathTemplate(c.PathTemplate)
+	go runSink(c.Protocol, g, c.Interval, func(families []*dto.MetricFamily, ts time.Time) error {
+		lines := []string{}
+		for _, mf := range families {
+			name := strings.TrimPrefix(mf.GetName(), exporterName + "_")
+			for _, m := range mf.Metric {
+				v, ok := metricValue(m)
+				if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+					continue
+				}
+				labels := metricLabels(m)
+				for k, v := range c.Tags {
+					labels[k] = v
+				}
+				path := tmpl.expand(name, labels)
+				value := strconv.FormatFloat(v, 'f', -1, 64)
+				if c.Protocol == graphiteProtocolStatsD {
+					// In StatsD, a gauge value with a leading
+					// sign means "adjust by this amount", so to
+					// set a negative value we need to zero it
+					// first.
+					if v < 0 {
+						lines = append(lines, path + ":0|g")
+					}
+					lines = append(lines, path + ":" + value + "|g")
+				} else {
+					lines = append(lines, path + " " + value + " " + strconv.FormatInt(ts.Unix(), 10))
+				}
+			}
+		}
+		log.WithFields(log.Fields{"lines": len(lines)}).Debugf("Writing %s data", c.Protocol)
+		if c.Transport == "udp" {
+			return writeLinesUDP(c.Address, lines)
+		}
+		conn, err := net.DialTimeout("tcp", c.Address, 10 * time.Second)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+		return err
+	})
+}
+
+// A graphitePathTemplate determines how metric names and labels are turned
+// into Graphite/StatsD paths.  The template is a dot-separated path which can
+// contain the following placeholders:
+//
+//   <metric>    The full metric name (without the "powerwall_" prefix)
+//   <subsystem> The first word of the metric name (e.g. "battery")
+//   <field>     The rest of the metric name (e.g. "remaining_joules")
+//   <labels>    The values of all labels not otherwise used in the template
+//   <name>      The value of the label (or configured tag) called "name"
+//
+// If the template does not contain <labels>, any unused labels are added to
+// the end of the path, so that every series always gets a unique path.  For
+// the same reason, empty label values are written as graphiteEmptyLabel
+// instead of being left out.  Other components which end up empty (such as
+// <field>, for a one-word metric name) are dropped.
+type graphitePathTemplate struct {
+	parts []string
+	used map[string]bool
+	hasLabels bool
+}
+
+var graphitePlaceholderRegexp = regexp.MustCompile(`<[A-Za-z_][A-Za-z0-9_]*>`)
+var graphiteInvalidChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// This can never be the result of sanitizing a non-empty label value (leading
+// and trailing underscores are always trimmed), so it can't be confused with
+// one.
+const graphiteEmptyLabel = "_"
+
+func newGraphitePathTemplate(tmpl string) *graphitePathTemplate {
+	t := &graphitePathTemplate{
+		parts: strings.Split(tmpl, "."),
+		used: make(map[string]bool),
+	}
+	for _, p := range graphitePlaceholderRegexp.FindAllString(tmpl, -1) {
+		name := strings.Trim(p, "<>")
+		switch name {
+		case "metric", "subsystem", "field":
+		case "labels":
+			t.hasLabels = true
+		default:
+			t.used[name] = true
+		}
+	}
+	return t
+}
+
+func (t *graphitePathTemplate) expand(name string, labels map[string]string) string {
+	subsystem, field := name, ""
+	if i := strings.Index(name, "_"); i >= 0 {
+		subsystem, field = name[:i], name[i+1:]
+	}
+
+	keys := []string{}
+	for k := range labels {
+		if !t.used[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	extra := []string{}
+	for _, k := range keys {
+		extra = append(extra, graphiteLabel(labels[k]))
+	}
+
+	result := []string{}
+	for _, part := range t.parts {
+		if part == "<labels>" {
+			result = append(result, extra...)
+			continue
+		}
+		part = graphitePlaceholderRegexp.ReplaceAllStringFunc(part, func(p string) string {
+			switch p {
+			case "<metric>":
+				return name
+			case "<subsystem>":
+				return subsystem
+			case "<field>":
+				return field
+			case "<labels>":
+				return strings.Join(extra, "_")
+			}
+			return graphiteLabel(labels[strings.Trim(p, "<>")])
+		})
+		result = append(result, part)
+	}
+	if !t.hasLabels {
+		result = append(result, extra...)
+	}
+
+	path := []string{}
+	for _, p := range result {
+		if p != "" {
+			path = append(path, p)
+		}
+	}
+	return strings.Join(path, ".")
+}
+
+// graphiteSanitize makes a label value safe to use as a single path component
+// (in particular, dots would otherwise create extra levels of hierarchy)
+func graphiteSanitize(s string) string {
+	return strings.Trim(graphiteInvalidChars.ReplaceAllString(s, "_"), "_")
+}
+
+// graphiteLabel returns the path component for a label value.
+func graphiteLabel(s string) string {
+	s = graphiteSanitize(s)
+	if s == "" {
+		return graphiteEmptyLabel
+	}
+	return s
+}
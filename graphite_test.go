@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGraphitePathTemplate(t *testing.T) {
+	tests := []struct {
+		name string
+		template string
+		metric string
+		labels map[string]string
+		want string
+	}{
+		{
+			name: "default",
+			template: defaultGraphitePathTemplate,
+			metric: "battery_remaining_joules",
+			labels: map[string]string{"serial": "TG123"},
+			want: "powerwall.battery_remaining_joules.TG123",
+		},
+		{
+			name: "no labels",
+			template: defaultGraphitePathTemplate,
+			metric: "charge_ratio",
+			labels: map[string]string{},
+			want: "powerwall.charge_ratio",
+		},
+		{
+			name: "label order",
+			template: defaultGraphitePathTemplate,
+			metric: "network_state",
+			labels: map[string]string{"type": "wifi", "name": "Home", "state": "up", "reason": ""},
+			want: "powerwall.network_state.Home._.up.wifi",
+		},
+		{
+			name: "empty label keeps its place",
+			template: defaultGraphitePathTemplate,
+			metric: "sitemaster_busy",
+			labels: map[string]string{"a": "", "b": "x"},
+			want: "powerwall.sitemaster_busy._.x",
+		},
+		{
+			name: "other empty label",
+			template: defaultGraphitePathTemplate,
+			metric: "sitemaster_busy",
+			labels: map[string]string{"a": "x", "b": ""},
+			want: "powerwall.sitemaster_busy.x._",
+		},
+		{
+			name: "sanitized",
+			template: defaultGraphitePathTemplate,
+			metric: "dev_instant_power_watts",
+			labels: map[string]string{"serial": "a.b c", "category": "_site_"},
+			want: "powerwall.dev_instant_power_watts.site.a_b_c",
+		},
+		{
+			name: "named labels and tags",
+			template: "powerwall.<site>.<subsystem>.<labels>.<field>",
+			metric: "battery_remaining_joules",
+			labels: map[string]string{"serial": "TG123", "site": "home"},
+			want: "powerwall.home.battery.TG123.remaining_joules",
+		},
+		{
+			name: "empty named label",
+			template: "powerwall.<site>.<metric>",
+			metric: "charge_ratio",
+			labels: map[string]string{"site": "", "serial": "TG1"},
+			want: "powerwall._.charge_ratio.TG1",
+		},
+		{
+			name: "one-word metric",
+			template: "powerwall.<subsystem>.<field>.<labels>",
+			metric: "info",
+			labels: map[string]string{"version": "1.2"},
+			want: "powerwall.info.1_2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newGraphitePathTemplate(tt.template).expand(tt.metric, tt.labels)
+			if got != tt.want {
+				t.Errorf("expand(%q, %v) = %q, want %q", tt.metric, tt.labels, got, tt.want)
+			}
+		})
+	}
+}
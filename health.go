@@ -0,0 +1,232 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultBatteryHealthWindowDays = 30
+	defaultBatteryForgetAfter = "720h" // 30 days
+
+	healthStateKey = "battery_health"
+	// How many days of daily maximum capacity to keep for working out the
+	// loss rate.
+	healthHistoryDays = 365
+	// Don't report a loss rate until we have at least this many days of
+	// history (before that it's mostly just noise).
+	healthMinTrendDays = 7
+)
+
+type BatteriesConfig struct {
+	ExpectedBatteries int `yaml:"expected_batteries"`
+	NameplateKWh map[string]float64 `yaml:"nameplate_kwh"`
+	HealthWindowDays int `yaml:"health_window_days"`
+	ForgetAfter time.Duration `yaml:"forget_after"`
+}
+
+func checkBatteriesConfig(c *BatteriesConfig) {
+	if c.ExpectedBatteries < 0 {
+		log.Fatal("batteries.expected_batteries must not be negative")
+	}
+	for serial, kwh := range c.NameplateKWh {
+		if kwh <= 0 {
+			log.Fatalf("batteries.nameplate_kwh for %q must be greater than zero", serial)
+		}
+	}
+	if c.HealthWindowDays < 1 || c.HealthWindowDays > healthHistoryDays {
+		log.Fatalf("batteries.health_window_days must be between 1 and %d", healthHistoryDays)
+	}
+	if c.ForgetAfter <= 0 {
+		log.Fatal("batteries.forget_after must be greater than zero")
+	}
+}
+
+type dailyCapacity struct {
+	Day string `json:"day"`
+	Joules float64 `json:"joules"`
+}
+
+// batteryHealth is the saved history for a single battery.
+type batteryHealth struct {
+	// The highest full-pack energy ever seen, which is used as the
+	// nameplate capacity if one isn't configured.
+	LearnedNameplate float64 `json:"learned_nameplate"`
+	// The highest full-pack energy seen on each day, oldest first.
+	Daily []dailyCapacity `json:"daily"`
+	// When the gateway last reported this battery.  (This is only saved
+	// along with other changes, so may be up to a day out of date after a
+	// restart.)
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// healthTracker keeps track of each battery's full-pack energy over time, to
+// see how its capacity is holding up compared to when it was new.
+type healthTracker struct {
+	config *BatteriesConfig
+	store *stateStore
+	mu sync.Mutex
+	batteries map[string]*batteryHealth
+	// The latest lifetime discharged energy for each battery (not saved,
+	// since the gateway reports it every time anyway)
+	discharged map[string]float64
+}
+
+func newHealthTracker(c *powerwallCollector, bc *BatteriesConfig, store *stateStore) *healthTracker {
+	c.newDesc("battery_nameplate_joules", "Nameplate (new) capacity of the battery, as configured or learned", []string{"serial"})
+	c.newDesc("battery_max_full_pack_joules", "Highest full-pack energy reported for the battery over the health window", []string{"serial"})
+	c.newDesc("battery_health_ratio", "Battery state of health (maximum recent full-pack energy compared to nameplate capacity)", []string{"serial"})
+	c.newDesc("battery_capacity_loss_ratio_per_year", "Rate at which the battery is losing capacity, as a proportion of nameplate capacity per year", []string{"serial"})
+	c.newDesc("battery_equivalent_cycles_total", "Total energy discharged over battery's lifetime, in multiples of its configured nameplate capacity", []string{"serial"})
+	t := &healthTracker{
+		config: bc,
+		store: store,
+		batteries: make(map[string]*batteryHealth),
+		discharged: make(map[string]float64),
+	}
+	if store.get(healthStateKey, &t.batteries) {
+		log.WithFields(log.Fields{"batteries": len(t.batteries)}).Info("Restored battery health history")
+		for _, b := range t.batteries {
+			// Saved before we kept track of this
+			if b.LastSeen.IsZero() {
+				b.LastSeen = time.Now()
+			}
+		}
+	}
+	return t
+}
+
+func (t *healthTracker) update(snap *Snapshot) {
+	if snap.SystemStatus == nil {
+		return
+	}
+	day := snap.Time.In(config.Site.location).Format("2006-01-02")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	changed := false
+	t.discharged = make(map[string]float64)
+	for _, block := range snap.SystemStatus.BatteryBlocks {
+		serial := block.PackageSerialNumber
+		full := float64(block.NominalFullPackEnergy) * 3600
+		// (Zero means the gateway isn't reporting it properly yet;
+		// see the comment in Collect.)
+		if serial != "" && block.EnergyDischarged != 0 {
+			t.discharged[serial] = float64(block.EnergyDischarged) * 3600
+		}
+		if serial == "" || full <= 0 {
+			continue
+		}
+		b, ok := t.batteries[serial]
+		if !ok {
+			b = &batteryHealth{}
+			t.batteries[serial] = b
+		}
+		b.LastSeen = snap.Time
+		if full > b.LearnedNameplate {
+			b.LearnedNameplate = full
+			changed = true
+		}
+		n := len(b.Daily)
+		if n == 0 || b.Daily[n - 1].Day != day {
+			b.Daily = append(b.Daily, dailyCapacity{Day: day, Joules: full})
+			if len(b.Daily) > healthHistoryDays {
+				b.Daily = b.Daily[len(b.Daily) - healthHistoryDays:]
+			}
+			changed = true
+		} else if full > b.Daily[n - 1].Joules {
+			b.Daily[n - 1].Joules = full
+			changed = true
+		}
+	}
+	// Batteries which have been removed or replaced shouldn't hang around
+	// forever, but one which has just dropped out for a while should
+	// keep its history.
+	for serial, b := range t.batteries {
+		if snap.Time.Sub(b.LastSeen) > t.config.ForgetAfter {
+			log.WithFields(log.Fields{"serial": serial, "last_seen": b.LastSeen}).Info("Battery has not been reported for a long time.  Forgetting its health history.")
+			delete(t.batteries, serial)
+			changed = true
+		}
+	}
+	if changed {
+		t.store.set(healthStateKey, t.batteries)
+	}
+}
+
+// lossRate fits a straight line to the daily capacity history (by least
+// squares) and returns the slope, in joules per year (positive meaning the
+// capacity is going down).  It returns false if there isn't enough history.
+func lossRate(daily []dailyCapacity) (float64, bool) {
+	if len(daily) < healthMinTrendDays {
+		return 0, false
+	}
+	var n, sumX, sumY, sumXY, sumXX float64
+	for _, d := range daily {
+		day, err := time.Parse("2006-01-02", d.Day)
+		if err != nil {
+			continue
+		}
+		x := float64(day.Unix()) / (365.25 * 24 * 3600)
+		n++
+		sumX += x
+		sumY += d.Joules
+		sumXY += x * d.Joules
+		sumXX += x * x
+	}
+	denom := n * sumXX - sumX * sumX
+	if n < healthMinTrendDays || denom == 0 {
+		return 0, false
+	}
+	return -(n * sumXY - sumX * sumY) / denom, true
+}
+
+func (t *healthTracker) collect(c *powerwallCollector, ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	serials := []string{}
+	for serial := range t.batteries {
+		serials = append(serials, serial)
+	}
+	sort.Strings(serials)
+	for _, serial := range serials {
+		b := t.batteries[serial]
+		nameplate := b.LearnedNameplate
+		kwh, configured := t.config.NameplateKWh[serial]
+		if configured {
+			nameplate = kwh * 3600 * 1000
+		}
+		c.setGauge64(ch, "battery_nameplate_joules", nameplate, serial)
+
+		window := b.Daily
+		if len(window) > t.config.HealthWindowDays {
+			window = window[len(window) - t.config.HealthWindowDays:]
+		}
+		max := 0.0
+		for _, d := range window {
+			if d.Joules > max {
+				max = d.Joules
+			}
+		}
+		if max > 0 {
+			c.setGauge64(ch, "battery_max_full_pack_joules", max, serial)
+			c.setGauge64(ch, "battery_health_ratio", max / nameplate, serial)
+		}
+		if rate, ok := lossRate(b.Daily); ok {
+			c.setGauge64(ch, "battery_capacity_loss_ratio_per_year", rate / nameplate, serial)
+		}
+		// This uses the nameplate capacity rather than the current
+		// full-pack energy, because the latter wanders up and down,
+		// which would make the counter go backwards sometimes.  The
+		// learned nameplate can go up too, so it has to be a
+		// configured one.
+		if discharged, ok := t.discharged[serial]; ok && configured {
+			c.setCounter64(ch, "battery_equivalent_cycles_total", discharged / nameplate, serial)
+		}
+	}
+}
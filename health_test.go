@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+)
+
+// batterySnapshot returns a snapshot with a system status reporting a battery
+// (with 13.5 kWh full-pack energy, half full) for each of the given serials.
+func batterySnapshot(t *testing.T, when time.Time, serials ...string) *Snapshot {
+	t.Helper()
+	blocks := []string{}
+	for _, serial := range serials {
+		blocks = append(blocks, fmt.Sprintf(`{"PackageSerialNumber": %q, "nominal_full_pack_energy": 13500, "nominal_energy_remaining": 6750, "energy_discharged": 1000000}`, serial))
+	}
+	status := &powerwall.SystemStatusData{}
+	if err := json.Unmarshal([]byte(`{"battery_blocks": [` + strings.Join(blocks, ",") + `]}`), status); err != nil {
+		t.Fatal(err)
+	}
+	return &Snapshot{Time: when, SystemStatus: status}
+}
+
+func TestHealthTrackerForget(t *testing.T) {
+	start := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	tests := []struct {
+		name string
+		// Serials reported at each time (offsets from start)
+		times []time.Duration
+		serials [][]string
+		want []string
+	}{
+		{
+			name: "all present",
+			times: []time.Duration{0, 40 * day},
+			serials: [][]string{{"TG1", "TG2"}, {"TG1", "TG2"}},
+			want: []string{"TG1", "TG2"},
+		},
+		{
+			name: "dropped out for a while",
+			times: []time.Duration{0, day, 20 * day},
+			serials: [][]string{{"TG1", "TG2"}, {"TG1"}, {"TG1"}},
+			want: []string{"TG1", "TG2"},
+		},
+		{
+			name: "came back",
+			times: []time.Duration{0, 20 * day, 40 * day},
+			serials: [][]string{{"TG1", "TG2"}, {"TG1", "TG2"}, {"TG1"}},
+			want: []string{"TG1", "TG2"},
+		},
+		{
+			name: "replaced",
+			times: []time.Duration{0, day, 31 * day},
+			serials: [][]string{{"TG1", "TG2"}, {"TG1", "TG3"}, {"TG1", "TG3"}},
+			want: []string{"TG1", "TG3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := &BatteriesConfig{HealthWindowDays: defaultBatteryHealthWindowDays, ForgetAfter: 30 * day}
+			tracker := newHealthTracker(newTestCollector(t), bc, loadStateStore(""))
+			for i, offset := range tt.times {
+				tracker.update(batterySnapshot(t, start.Add(offset), tt.serials[i]...))
+			}
+			seen := make(map[string]bool)
+			for serial := range tracker.batteries {
+				seen[serial] = true
+			}
+			if got := sortedKeys(seen); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("batteries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
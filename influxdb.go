@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	defaultInfluxDBAPIVersion = 1
+	defaultInfluxDBDatabase = "powerwall"
+	defaultInfluxDBInterval = "60s"
+	defaultInfluxDBSchema = influxSchemaPrometheus
+
+	// Schemas which can be selected with the "schema" config option
+	influxSchemaPrometheus = "prometheus"
+	influxSchemaDashboard = "powerwall-dashboard"
+
+	// Powerwall-Dashboard stores its raw data in the "http" measurement
+	// of the "raw" retention policy.
+	influxDashboardMeasurement = "http"
+	influxDashboardRetentionPolicy = "raw"
+)
+
+type InfluxDBConfig struct {
+	URL string `yaml:"url"`
+	File string `yaml:"file"`
+	APIVersion int `yaml:"api_version"`
+	Database string `yaml:"database"`
+	RetentionPolicy string `yaml:"retention_policy"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Org string `yaml:"org"`
+	Bucket string `yaml:"bucket"`
+	Token string `yaml:"token"`
+	Interval time.Duration `yaml:"interval"`
+	Schema string `yaml:"schema"`
+	Measurement string `yaml:"measurement"`
+	Tags map[string]string `yaml:"tags"`
+}
+
+// influxDashboardFields maps our metric names (without the exporter prefix)
+// to the field names used by Powerwall-Dashboard for the corresponding
+// meters/aggregates values, along with a scale factor to convert our units
+// back into the ones the gateway (and thus Powerwall-Dashboard) uses.
+var influxDashboardFields = map[string]struct{
+	field string
+	scale float64
+}{
+	"instant_power_watts": {"instant_power", 1},
+	"instant_reactive_power_watts": {"instant_reactive_power", 1},
+	"instant_apparent_power_watts": {"instant_apparent_power", 1},
+	"frequency_hz": {"frequency", 1},
+	"exported_joules_total": {"energy_exported", 1.0 / 3600},
+	"imported_joules_total": {"energy_imported", 1.0 / 3600},
+	"instant_average_volts": {"instant_average_voltage", 1},
+	"instant_average_amps": {"instant_average_current", 1},
+	"instant_total_amps": {"instant_total_current", 1},
+}
+
+func setInfluxDBDefaults(c *InfluxDBConfig) {
+	if c.APIVersion == 0 {
+		c.APIVersion = defaultInfluxDBAPIVersion
+	}
+	if c.Database == "" {
+		c.Database = defaultInfluxDBDatabase
+	}
+	if c.Interval == 0 {
+		c.Interval, _ = time.ParseDuration(defaultInfluxDBInterval)
+	}
+	if c.Schema == "" {
+		c.Schema = defaultInfluxDBSchema
+	}
+	if c.Schema == influxSchemaDashboard && c.RetentionPolicy == "" {
+		c.RetentionPolicy = influxDashboardRetentionPolicy
+	}
+}
+
+func checkInfluxDBConfig(c *InfluxDBConfig) {
+	if c.URL == "" && c.File == "" {
+		log.Fatal("One of influxdb.url or influxdb.file must be specified in config file")
+	}
+	if c.URL != "" {
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			log.Fatalf("Invalid influxdb.url in config file: %s", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "udp":
+		default:
+			log.Fatalf("Unsupported influxdb.url scheme %q (must be http, https, or udp)", u.Scheme)
+		}
+	}
+	if c.APIVersion != 1 && c.APIVersion != 2 {
+		log.Fatalf("Invalid influxdb.api_version %d (must be 1 or 2)", c.APIVersion)
+	}
+	if c.APIVersion == 2 && c.Bucket == "" && strings.HasPrefix(c.URL, "http") {
+		log.Fatal("Required parameter influxdb.bucket not specified in config file (needed for api_version 2)")
+	}
+	if c.Schema != influxSchemaPrometheus && c.Schema != influxSchemaDashboard {
+		log.Fatalf("Invalid influxdb.schema %q (must be %q or %q)", c.Schema, influxSchemaPrometheus, influxSchemaDashboard)
+	}
+}
+
+// startInfluxDBSink starts a background goroutine which periodically writes
+// all collected metrics to InfluxDB (or a file or UDP listener) in InfluxDB
+// line protocol format.
+func startInfluxDBSink(g prometheus.Gatherer, c *InfluxDBConfig) {
+	go runSink("influxdb", g, c.Interval, func(families []*dto.MetricFamily, ts time.Time) error {
+		var lines []string
+		if c.Schema == influxSchemaDashboard {
+			lines = influxDashboardLines(c, families, ts)
+		} else {
+			lines = influxPrometheusLines(c, families, ts)
+		}
+		if len(lines) == 0 {
+			return nil
+		}
+		log.WithFields(log.Fields{"lines": len(lines)}).Debug("Writing InfluxDB data")
+		if c.File != "" {
+			err := influxWriteFile(c, lines)
+			if err != nil {
+				return err
+			}
+		}
+		if c.URL != "" {
+			return influxWriteURL(c, lines)
+		}
+		return nil
+	})
+}
+
+// influxPrometheusLines produces line protocol which mirrors the Prometheus
+// metrics: by default each metric gets its own measurement with a single
+// "value" field, but if a measurement name is configured, everything is put
+// into that one measurement instead, with the metric names as field names.
+func influxPrometheusLines(c *InfluxDBConfig, families []*dto.MetricFamily, ts time.Time) []string {
+	lines := []string{}
+	for _, mf := range families {
+		measurement := mf.GetName()
+		field := "value"
+		if c.Measurement != "" {
+			measurement = c.Measurement
+			field = mf.GetName()
+		}
+		for _, m := range mf.Metric {
+			v, ok := metricValue(m)
+			if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			tags := metricLabels(m)
+			for k, v := range c.Tags {
+				tags[k] = v
+			}
+			lines = append(lines, influxLine(measurement, tags, map[string]float64{field: v}, ts))
+		}
+	}
+	return lines
+}
+
+// influxDashboardLines produces a single line in the format written by the
+// Powerwall-Dashboard project (https://github.com/jasonacox/Powerwall-Dashboard),
+// so that its existing dashboards and continuous queries can be used
+// unchanged with data from this exporter.
+func influxDashboardLines(c *InfluxDBConfig, families []*dto.MetricFamily, ts time.Time) []string {
+	fields := map[string]float64{}
+	for _, mf := range families {
+		name := strings.TrimPrefix(mf.GetName(), exporterName + "_")
+		for _, m := range mf.Metric {
+			v, ok := metricValue(m)
+			if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			if name == "charge_ratio" {
+				fields["percentage"] = v * 100
+				continue
+			}
+			mapping, ok := influxDashboardFields[name]
+			if !ok {
+				continue
+			}
+			category := metricLabels(m)["category"]
+			fields[category + "_" + mapping.field] = v * mapping.scale
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	measurement := influxDashboardMeasurement
+	if c.Measurement != "" {
+		measurement = c.Measurement
+	}
+	return []string{influxLine(measurement, c.Tags, fields, ts)}
+}
+
+var influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+var influxKeyEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influxLine formats a single line of InfluxDB line protocol (with
+// second-precision timestamp).  Tags and fields are sorted by key, as
+// recommended by the InfluxDB docs for best performance.
+func influxLine(measurement string, tags map[string]string, fields map[string]float64, ts time.Time) string {
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscaper.Replace(measurement))
+
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		// InfluxDB does not allow empty tag values
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString(",")
+		b.WriteString(influxKeyEscaper.Replace(k))
+		b.WriteString("=")
+		b.WriteString(influxKeyEscaper.Replace(tags[k]))
+	}
+
+	keys = make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i == 0 {
+			b.WriteString(" ")
+		} else {
+			b.WriteString(",")
+		}
+		b.WriteString(influxKeyEscaper.Replace(k))
+		b.WriteString("=")
+		b.WriteString(strconv.FormatFloat(fields[k], 'f', -1, 64))
+	}
+
+	b.WriteString(" ")
+	b.WriteString(strconv.FormatInt(ts.Unix(), 10))
+	return b.String()
+}
+
+func influxWriteFile(c *InfluxDBConfig, lines []string) error {
+	f, err := os.OpenFile(c.File, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func influxWriteURL(c *InfluxDBConfig, lines []string) error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "udp" {
+		return writeLinesUDP(u.Host, lines)
+	}
+
+	q := url.Values{}
+	q.Set("precision", "s")
+	if c.APIVersion == 2 {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		q.Set("org", c.Org)
+		q.Set("bucket", c.Bucket)
+	} else {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+		q.Set("db", c.Database)
+		if c.RetentionPolicy != "" {
+			q.Set("rp", c.RetentionPolicy)
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	body := []byte(strings.Join(lines, "\n") + "\n")
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Token " + c.Token)
+	} else if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("InfluxDB write returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"html/template"
+	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -25,6 +25,9 @@ const (
 	projectURL = "https://github.com/foogod/powerwall_exporter"
 	defaultListenAddress = ":9871"
 	defaultMetricsPath = "/metrics"
+	defaultSnapshotMaxAge = "30s"
+	defaultDashboardRefresh = "30s"
+	defaultSiteTimezone = "Local"
 	defaultLoginEmail = "powerwall_exporter@example.org"
 	defaultRetryInterval = "1s"
 	defaultRetryTimeout = "0s" // Retries disabled by default
@@ -83,16 +86,35 @@ func main() {
 }
 
 func pwclientLog(v ...interface{}) {
-        log.Debug(v...)
+        log.WithFields(traceClientLog(fmt.Sprint(v...))).Debug(v...)
 }
 
 type Config struct {
 	Web WebConfig
 	Device DeviceConfig
+	Site SiteConfig
+	Stream StreamConfig
+	State StateConfig
+	Batteries BatteriesConfig
+	Ratios RatiosConfig
+	Estimates EstimatesConfig
+	Outages OutagesConfig
+	Schema SchemaConfig
+	InfluxDB *InfluxDBConfig `yaml:"influxdb"`
+	OTLP *OTLPConfig `yaml:"otlp"`
+	Graphite *GraphiteConfig `yaml:"graphite"`
+	Proxy *ProxyConfig `yaml:"proxy"`
+	Tariff *TariffConfig `yaml:"tariff"`
+	Demand *DemandConfig `yaml:"demand"`
+	Events *EventsConfig `yaml:"events"`
+	CustomMetrics []CustomMetricConfig `yaml:"custom_metrics"`
+	DerivedMetrics []DerivedMetricConfig `yaml:"derived_metrics"`
 }
 type WebConfig struct {
 	ListenAddress string `yaml:"listen_address"`
 	MetricsPath string `yaml:"metrics_path"`
+	SnapshotMaxAge time.Duration `yaml:"snapshot_max_age"`
+	DashboardRefresh time.Duration `yaml:"dashboard_refresh"`
 }
 type DeviceConfig struct {
 	GatewayAddress string `yaml:"gateway_address"`
@@ -100,10 +122,16 @@ type DeviceConfig struct {
 	LoginPassword string `yaml:"login_password"`
 	RetryInterval time.Duration `yaml:"retry_interval"`
 	RetryTimeout time.Duration `yaml:"retry_timeout"`
+	PollInterval time.Duration `yaml:"poll_interval"`
 	TLSCertFile string `yaml:"tls_cert_file"`
 	cert *x509.Certificate
 }
 
+type SiteConfig struct {
+	Timezone string `yaml:"timezone"`
+	location *time.Location
+}
+
 var config Config
 
 func loadConfig(filename string) {
@@ -120,15 +148,51 @@ func loadConfig(filename string) {
 	// Set defaults
 	retryInterval, _ := time.ParseDuration(defaultRetryInterval)
 	retryTimeout, _ := time.ParseDuration(defaultRetryTimeout)
+	snapshotMaxAge, _ := time.ParseDuration(defaultSnapshotMaxAge)
+	dashboardRefresh, _ := time.ParseDuration(defaultDashboardRefresh)
 	config.Web = WebConfig{
 		ListenAddress: defaultListenAddress,
 		MetricsPath: defaultMetricsPath,
+		SnapshotMaxAge: snapshotMaxAge,
+		DashboardRefresh: dashboardRefresh,
 	}
 	config.Device = DeviceConfig{
 		LoginEmail: defaultLoginEmail,
 		RetryInterval: retryInterval,
 		RetryTimeout: retryTimeout,
 	}
+	config.Site = SiteConfig{
+		Timezone: defaultSiteTimezone,
+	}
+	batteryForgetAfter, _ := time.ParseDuration(defaultBatteryForgetAfter)
+	config.Batteries = BatteriesConfig{
+		HealthWindowDays: defaultBatteryHealthWindowDays,
+		ForgetAfter: batteryForgetAfter,
+	}
+	ratiosWindow, _ := time.ParseDuration(defaultRatiosWindow)
+	config.Ratios = RatiosConfig{
+		Window: ratiosWindow,
+	}
+	estimatesWindow, _ := time.ParseDuration(defaultEstimatesWindow)
+	config.Estimates = EstimatesConfig{
+		Window: estimatesWindow,
+	}
+	outagesDebounce, _ := time.ParseDuration(defaultOutagesDebounce)
+	config.Outages = OutagesConfig{
+		Debounce: outagesDebounce,
+	}
+	schemaCheckInterval, _ := time.ParseDuration(defaultSchemaCheckInterval)
+	config.Schema = SchemaConfig{
+		CheckInterval: schemaCheckInterval,
+	}
+	streamKeepalive, _ := time.ParseDuration(defaultStreamKeepalive)
+	streamInterval, _ := time.ParseDuration(defaultStreamInterval)
+	config.Stream = StreamConfig{
+		MaxClients: defaultStreamMaxClients,
+		ClientBuffer: defaultStreamClientBuffer,
+		Keepalive: streamKeepalive,
+		Interval: streamInterval,
+	}
 
 	err = yaml.UnmarshalStrict(yamlFile, &config)
 	if err != nil {
@@ -142,6 +206,63 @@ func loadConfig(filename string) {
 	if config.Device.LoginPassword == "" {
 		log.Fatal("Required parameter device.login_password not specified in config file")
 	}
+
+	config.Site.location, err = time.LoadLocation(config.Site.Timezone)
+	if err != nil {
+		log.Fatalf("Invalid site.timezone %q: %s", config.Site.Timezone, err)
+	}
+	if config.Web.DashboardRefresh <= 0 {
+		log.Fatal("web.dashboard_refresh must be greater than zero")
+	}
+	checkStreamConfig(&config.Stream)
+	checkBatteriesConfig(&config.Batteries)
+	checkRatiosConfig(&config.Ratios)
+	checkEstimatesConfig(&config.Estimates)
+	checkOutagesConfig(&config.Outages)
+	checkSchemaConfig(&config.Schema)
+
+	// Optional sections
+	if config.InfluxDB != nil {
+		setInfluxDBDefaults(config.InfluxDB)
+		checkInfluxDBConfig(config.InfluxDB)
+	}
+	if config.OTLP != nil {
+		setOTLPDefaults(config.OTLP)
+		checkOTLPConfig(config.OTLP)
+	}
+	if config.Graphite != nil {
+		setGraphiteDefaults(config.Graphite)
+		checkGraphiteConfig(config.Graphite)
+	}
+	if config.Proxy != nil {
+		setProxyDefaults(config.Proxy)
+		checkProxyConfig(config.Proxy)
+	}
+	if config.Tariff != nil {
+		setTariffDefaults(config.Tariff)
+		checkTariffConfig(config.Tariff)
+	}
+	if config.Events != nil {
+		setEventsDefaults(config.Events)
+		checkEventsConfig(config.Events)
+	}
+	if config.Demand != nil {
+		setDemandDefaults(config.Demand)
+		checkDemandConfig(config.Demand)
+		// Demand tracking needs regular samples, whether or not
+		// anybody is asking for metrics.
+		if config.Device.PollInterval == 0 || config.Device.PollInterval > config.Demand.SampleInterval {
+			config.Device.PollInterval = config.Demand.SampleInterval
+		}
+	}
+	for i := range config.CustomMetrics {
+		setCustomMetricDefaults(&config.CustomMetrics[i])
+		checkCustomMetricConfig(&config.CustomMetrics[i])
+	}
+	for i := range config.DerivedMetrics {
+		setDerivedMetricDefaults(&config.DerivedMetrics[i])
+		checkDerivedMetricConfig(&config.DerivedMetrics[i])
+	}
 }
 
 func loadTLSCert(filename string) {
@@ -187,8 +308,6 @@ func fetchTLSCert() {
 }
 
 func startServer() {
-	http.HandleFunc("/", indexPageHandler)
-
 	pwclient := powerwall.NewClient(config.Device.GatewayAddress, config.Device.LoginEmail, config.Device.LoginPassword)
 	pwclient.SetRetry(config.Device.RetryInterval, config.Device.RetryTimeout)
 
@@ -196,55 +315,80 @@ func startServer() {
 		pwclient.SetTLSCert(config.Device.cert)
 	}
 
+	store := loadStateStore(config.State.File)
+	collector := NewPowerwallCollector(pwclient)
+	gateway := collector.gateway
+	collector.addExtension(newFlowTracker(collector))
+	collector.addExtension(newRatioTracker(collector, &config.Ratios))
+	collector.addExtension(newEstimateTracker(collector, &config.Estimates))
+	if config.Tariff != nil {
+		collector.addExtension(newTariffTracker(collector, config.Tariff, store))
+	}
+	collector.addExtension(newTotalsTracker(collector, store))
+	collector.addExtension(newHealthTracker(collector, &config.Batteries, store))
+	collector.addExtension(newDischargeTracker(collector, &config.Batteries, store))
+	collector.addExtension(newPackTracker(collector, &config.Batteries, store))
+	collector.addExtension(newOutageTracker(collector, &config.Outages, store))
+	collector.addExtension(newFirmwareTracker(collector, store))
+	collector.addExtension(newSchemaChecker(collector, &config.Schema, gateway))
+	if config.Demand != nil {
+		collector.addExtension(newDemandTracker(collector, config.Demand, store))
+	}
+	if len(config.CustomMetrics) > 0 {
+		collector.addExtension(newCustomMetrics(collector, config.CustomMetrics, gateway))
+	}
 	reg := prometheus.NewRegistry()
-	reg.MustRegister(NewPowerwallCollector(pwclient))
+	reg.MustRegister(collector)
+	var gatherer prometheus.Gatherer = reg
+	if len(config.DerivedMetrics) > 0 {
+		gatherer = newDerivedGatherer(collector, reg, config.DerivedMetrics)
+	}
 	regLogger := log.New()
 	regLogger.Level = log.ErrorLevel
-	regHandler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+	regHandler := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
 		ErrorLog:      regLogger,
 		ErrorHandling: promhttp.ContinueOnError,
 	})
 	http.Handle(config.Web.MetricsPath, regHandler)
+	http.HandleFunc("/", dashboardHandler(collector))
+	http.HandleFunc("/api/v1/snapshot", snapshotHandler(collector))
 
-	log.WithFields(log.Fields{"listen_address": config.Web.ListenAddress, "metrics_path": config.Web.MetricsPath}).Info("Listening for HTTP connections")
-	log.Fatal(http.ListenAndServe(config.Web.ListenAddress, nil))
-}
+	hub := newStreamHub(&config.Stream)
+	collector.addListener(hub.publish)
+	http.Handle("/api/v1/stream", hub)
 
-func indexPageHandler(w http.ResponseWriter, r *http.Request) {
-	templateValues := struct{
-		Exporter string
-		Version string
-		MetricsPath string
-		ProjectURL string
-	}{exporterName, exporterVersion, config.Web.MetricsPath, projectURL}
-
-	// Ordinarily we should probably parse the template once ahead of time and
-	// reuse it, but people aren't likely to be calling this page over and over
-	// again normally, so this is fine for this case.
-	t, err := template.New("indexHTML").Parse(indexHTML)
-	if err != nil {
-		log.Errorf("Error parsing template for index HTML (/): %s", err)
-		http.Error(w, "Internal server error", 500)
-		return
+	if config.Events != nil {
+		journal := newEventJournal(config.Events)
+		collector.addListener(journal.update)
+		http.Handle("/api/v1/events", journal)
 	}
 
-	err = t.Execute(w, templateValues)
-	if err != nil {
-		log.Errorf("Error executing template for index HTML (/): %s", err)
+	if config.Proxy != nil {
+		http.Handle("/api/", newGatewayProxy(config.Proxy, gateway))
 	}
-}
 
-const indexHTML = `<!doctype html>
-<html>
-<head>
-        <meta charset="UTF-8">
-        <title>{{ .Exporter }} exporter</title>
-</head>
-<body>
-        <h1>{{ .Exporter }} exporter for Prometheus (Version {{ .Version }})</h1>
-        <p>Exported metrics are available at <a href="{{ .MetricsPath }}">{{ .MetricsPath }}</a></p>
-        <h2>More information:</h2>
-        <p><a href="{{ .ProjectURL }}">{{ .ProjectURL }}</a></p>
-</body>
-</html>
-`
+	if config.Device.PollInterval > 0 {
+		collector.startPoller("device", config.Device.PollInterval, nil)
+	}
+	if config.Stream.MaxClients > 0 && config.Stream.Interval > 0 {
+		// Stream clients want regular updates, but there's no point
+		// bothering the gateway for them if nobody is listening.
+		collector.startPoller("stream", config.Stream.Interval, hub.active)
+	}
+
+	if config.InfluxDB != nil {
+		startInfluxDBSink(gatherer, config.InfluxDB)
+	}
+	if config.OTLP != nil {
+		startOTLPExporter(gatherer, collector, config.OTLP)
+		if config.OTLP.Traces {
+			startTracing(config.OTLP)
+		}
+	}
+	if config.Graphite != nil {
+		startGraphiteSink(gatherer, config.Graphite)
+	}
+
+	log.WithFields(log.Fields{"listen_address": config.Web.ListenAddress, "metrics_path": config.Web.MetricsPath}).Info("Listening for HTTP connections")
+	log.Fatal(http.ListenAndServe(config.Web.ListenAddress, nil))
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+
+	"github.com/foogod/go-powerwall"
+)
+
+const (
+	defaultOTLPProtocol = otlpProtocolGRPC
+	defaultOTLPInterval = "60s"
+
+	otlpProtocolGRPC = "grpc"
+	otlpProtocolHTTP = "http"
+)
+
+type OTLPConfig struct {
+	Protocol string `yaml:"protocol"`
+	Endpoint string `yaml:"endpoint"`
+	Insecure bool `yaml:"insecure"`
+	Headers map[string]string `yaml:"headers"`
+	Interval time.Duration `yaml:"interval"`
+	Traces bool `yaml:"traces"`
+	ResourceAttributes map[string]string `yaml:"resource_attributes"`
+}
+
+func setOTLPDefaults(c *OTLPConfig) {
+	if c.Protocol == "" {
+		c.Protocol = defaultOTLPProtocol
+	}
+	if c.Interval == 0 {
+		c.Interval, _ = time.ParseDuration(defaultOTLPInterval)
+	}
+}
+
+func checkOTLPConfig(c *OTLPConfig) {
+	if c.Protocol != otlpProtocolGRPC && c.Protocol != otlpProtocolHTTP {
+		log.Fatalf("Invalid otlp.protocol %q (must be %q or %q)", c.Protocol, otlpProtocolGRPC, otlpProtocolHTTP)
+	}
+}
+
+// An otlpExporter exports all collected metrics to an OpenTelemetry collector
+// (or other OTLP receiver).  Since we want to include information about the
+// gateway in the resource attributes, we need to talk to the gateway first,
+// so this is all done in the background, and will keep trying until the
+// gateway can be reached.  Resources can't be changed once a meter provider
+// has been created, so if the gateway's firmware version changes, we replace
+// the whole provider.
+type otlpExporter struct {
+	config *OTLPConfig
+	gatherer prometheus.Gatherer
+	collector *powerwallCollector
+	startTime time.Time
+	mu sync.Mutex
+	provider *sdkmetric.MeterProvider
+	version string
+	restarting bool
+}
+
+func startOTLPExporter(g prometheus.Gatherer, collector *powerwallCollector, c *OTLPConfig) {
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.WithFields(log.Fields{"err": err}).Error("OpenTelemetry error")
+	}))
+
+	e := &otlpExporter{
+		config: c,
+		gatherer: g,
+		collector: collector,
+		startTime: time.Now(),
+	}
+	collector.addListener(e.update)
+	go func() {
+		if e.start() {
+			log.WithFields(log.Fields{"protocol": c.Protocol, "endpoint": c.Endpoint, "interval": c.Interval}).Info("Exporting metrics via OTLP")
+		}
+	}()
+}
+
+// start creates a new meter provider (with up to date resource attributes),
+// and replaces the current one (if any) with it.  It returns false if it
+// couldn't.
+func (e *otlpExporter) start() bool {
+	res, version := otlpResource(e.collector, e.config)
+	exporter, err := newOTLPMetricExporter(e.config)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Unable to create OTLP metric exporter")
+		return false
+	}
+	reader := sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(e.config.Interval),
+		sdkmetric.WithProducer(&otlpProducer{gatherer: e.gatherer, startTime: e.startTime}),
+	)
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithResource(res), sdkmetric.WithReader(reader))
+	otel.SetMeterProvider(provider)
+
+	e.mu.Lock()
+	old := e.provider
+	e.provider = provider
+	e.version = version
+	e.mu.Unlock()
+	if old != nil {
+		// This sends anything the old provider hasn't exported yet
+		// first.
+		err = old.Shutdown(context.Background())
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Warn("Error shutting down old OTLP meter provider")
+		}
+	}
+	return true
+}
+
+// update is registered as a collector listener, to notice when the gateway
+// firmware version changes.
+func (e *otlpExporter) update(snap *Snapshot) {
+	if snap.Status == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.provider == nil || e.restarting || snap.Status.Version == e.version {
+		return
+	}
+	log.WithFields(log.Fields{"old": e.version, "new": snap.Status.Version}).Info("Gateway firmware version changed.  Restarting OTLP export with new resource attributes.")
+	e.restarting = true
+	// We're called with the collector locked, and fetching the resource
+	// attributes needs it, so this has to happen in the background.
+	go func() {
+		e.start()
+		e.mu.Lock()
+		e.restarting = false
+		e.mu.Unlock()
+	}()
+}
+
+func newOTLPMetricExporter(c *OTLPConfig) (sdkmetric.Exporter, error) {
+	ctx := context.Background()
+	if c.Protocol == otlpProtocolHTTP {
+		opts := []otlpmetrichttp.Option{}
+		if c.Endpoint != "" {
+			opts = append(opts, otlpmetrichttp.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		if len(c.Headers) > 0 {
+			opts = append(opts, otlpmetrichttp.WithHeaders(c.Headers))
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	}
+	opts := []otlpmetricgrpc.Option{}
+	if c.Endpoint != "" {
+		opts = append(opts, otlpmetricgrpc.WithEndpoint(c.Endpoint))
+	}
+	if c.Insecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	}
+	if len(c.Headers) > 0 {
+		opts = append(opts, otlpmetricgrpc.WithHeaders(c.Headers))
+	}
+	return otlpmetricgrpc.New(ctx, opts...)
+}
+
+// otlpResource builds the OpenTelemetry resource describing this exporter
+// and the gateway it is talking to, and also returns the gateway firmware
+// version it used.  It blocks until it has been able to fetch the gateway
+// info.
+func otlpResource(collector *powerwallCollector, c *OTLPConfig) (*resource.Resource, string) {
+	version := ""
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName(exporterName + "_exporter"),
+		semconv.ServiceVersion(exporterVersion),
+	}
+	for {
+		var err error
+		// Use the gateway status from the regular collections if we
+		// can, rather than asking for it separately.
+		snap := collector.snapshot(config.Web.SnapshotMaxAge)
+		if status := snap.Status; status != nil {
+			var siteinfo *powerwall.SiteInfoData
+			siteinfo, err = collector.siteInfo()
+			if err == nil {
+				attrs = append(attrs,
+					attribute.String("powerwall.gateway.din", status.Din),
+					attribute.String("powerwall.gateway.version", status.Version),
+					attribute.String("powerwall.site.name", siteinfo.SiteName),
+				)
+				version = status.Version
+				break
+			}
+		} else {
+			err = fmt.Errorf("%s", snap.Errors["status"])
+		}
+		log.WithFields(log.Fields{"err": err}).Warn("Unable to fetch gateway info for OTLP resource attributes.  Retrying...")
+		time.Sleep(c.Interval)
+	}
+	for k, v := range c.ResourceAttributes {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+	return resource.NewWithAttributes(semconv.SchemaURL, attrs...), version
+}
+
+// otlpProducer converts the metrics from our Prometheus registry into
+// OpenTelemetry metric data.  Prometheus gauges become OTel gauges, counters
+// become cumulative monotonic sums, and histograms become cumulative
+// histograms.
+type otlpProducer struct {
+	gatherer prometheus.Gatherer
+	startTime time.Time
+}
+
+func (p *otlpProducer) Produce(ctx context.Context) ([]metricdata.ScopeMetrics, error) {
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("Error gathering metrics for OTLP export")
+	}
+	now := time.Now()
+	metrics := []metricdata.Metrics{}
+	for _, mf := range families {
+		switch mf.GetType() {
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			gauge := metricdata.Gauge[float64]{}
+			for _, m := range mf.Metric {
+				v, ok := metricValue(m)
+				if !ok {
+					continue
+				}
+				gauge.DataPoints = append(gauge.DataPoints, metricdata.DataPoint[float64]{
+					Attributes: otlpAttributes(m),
+					Time: now,
+					Value: v,
+				})
+			}
+			metrics = append(metrics, metricdata.Metrics{Name: mf.GetName(), Description: mf.GetHelp(), Data: gauge})
+		case dto.MetricType_COUNTER:
+			sum := metricdata.Sum[float64]{
+				Temporality: metricdata.CumulativeTemporality,
+				IsMonotonic: true,
+			}
+			for _, m := range mf.Metric {
+				v, ok := metricValue(m)
+				if !ok {
+					continue
+				}
+				sum.DataPoints = append(sum.DataPoints, metricdata.DataPoint[float64]{
+					Attributes: otlpAttributes(m),
+					StartTime: p.startTime,
+					Time: now,
+					Value: v,
+				})
+			}
+			metrics = append(metrics, metricdata.Metrics{Name: mf.GetName(), Description: mf.GetHelp(), Data: sum})
+		case dto.MetricType_HISTOGRAM:
+			hist := metricdata.Histogram[float64]{
+				Temporality: metricdata.CumulativeTemporality,
+			}
+			for _, m := range mf.Metric {
+				if m.Histogram == nil {
+					continue
+				}
+				dp := otlpHistogramPoint(m.Histogram)
+				dp.Attributes = otlpAttributes(m)
+				dp.StartTime = p.startTime
+				dp.Time = now
+				hist.DataPoints = append(hist.DataPoints, dp)
+			}
+			metrics = append(metrics, metricdata.Metrics{Name: mf.GetName(), Description: mf.GetHelp(), Data: hist})
+		}
+	}
+	scope := instrumentation.Scope{Name: exporterName + "_exporter", Version: exporterVersion}
+	return []metricdata.ScopeMetrics{{Scope: scope, Metrics: metrics}}, nil
+}
+
+// otlpHistogramPoint converts a Prometheus histogram into an OTel histogram
+// data point.  Prometheus bucket counts are cumulative (each includes
+// everything below it), whereas OTel's are not, and OTel has an explicit
+// bucket for everything above the highest bound, where Prometheus just has
+// the total count.
+func otlpHistogramPoint(h *dto.Histogram) metricdata.HistogramDataPoint[float64] {
+	dp := metricdata.HistogramDataPoint[float64]{
+		Count: h.GetSampleCount(),
+		Sum: h.GetSampleSum(),
+	}
+	below := uint64(0)
+	for _, b := range h.Bucket {
+		if math.IsInf(b.GetUpperBound(), +1) {
+			continue
+		}
+		dp.Bounds = append(dp.Bounds, b.GetUpperBound())
+		dp.BucketCounts = append(dp.BucketCounts, b.GetCumulativeCount() - below)
+		below = b.GetCumulativeCount()
+	}
+	dp.BucketCounts = append(dp.BucketCounts, dp.Count - below)
+	return dp
+}
+
+func otlpAttributes(m *dto.Metric) attribute.Set {
+	kvs := make([]attribute.KeyValue, 0, len(m.Label))
+	for _, lp := range m.Label {
+		kvs = append(kvs, attribute.String(lp.GetName(), lp.GetValue()))
+	}
+	return attribute.NewSet(kvs...)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestOTLPProducer(t *testing.T) {
+	family := func(name string, mtype dto.MetricType, value float64, labels ...string) *dto.MetricFamily {
+		m := &dto.Metric{}
+		for i := 0; i < len(labels); i += 2 {
+			m.Label = append(m.Label, &dto.LabelPair{Name: &labels[i], Value: &labels[i + 1]})
+		}
+		switch mtype {
+		case dto.MetricType_GAUGE:
+			m.Gauge = &dto.Gauge{Value: &value}
+		case dto.MetricType_COUNTER:
+			m.Counter = &dto.Counter{Value: &value}
+		default:
+			m.Untyped = &dto.Untyped{Value: &value}
+		}
+		return &dto.MetricFamily{Name: &name, Type: &mtype, Metric: []*dto.Metric{m}}
+	}
+	tests := []struct {
+		name string
+		family *dto.MetricFamily
+		wantSum bool
+		wantValue float64
+		wantLabel string
+	}{
+		{"gauge", family("powerwall_soe_percent", dto.MetricType_GAUGE, 69.1), false, 69.1, ""},
+		{"gauge with labels", family("powerwall_instant_power_watts", dto.MetricType_GAUGE, -250, "category", "battery"), false, -250, "battery"},
+		{"untyped", family("powerwall_thing", dto.MetricType_UNTYPED, 3), false, 3, ""},
+		{"counter", family("powerwall_energy_joules_total", dto.MetricType_COUNTER, 1e9, "category", "site"), true, 1e9, "site"},
+	}
+	start := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &otlpProducer{
+				gatherer: prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return []*dto.MetricFamily{tt.family}, nil }),
+				startTime: start,
+			}
+			scopes, err := p.Produce(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(scopes) != 1 || len(scopes[0].Metrics) != 1 {
+				t.Fatalf("got %+v, want one metric", scopes)
+			}
+			m := scopes[0].Metrics[0]
+			if m.Name != tt.family.GetName() {
+				t.Errorf("name = %q, want %q", m.Name, tt.family.GetName())
+			}
+			var dp metricdata.DataPoint[float64]
+			switch data := m.Data.(type) {
+			case metricdata.Gauge[float64]:
+				if tt.wantSum {
+					t.Fatalf("got gauge, want sum")
+				}
+				dp = data.DataPoints[0]
+			case metricdata.Sum[float64]:
+				if !tt.wantSum {
+					t.Fatalf("got sum, want gauge")
+				}
+				if !data.IsMonotonic || data.Temporality != metricdata.CumulativeTemporality {
+					t.Errorf("sum is not cumulative and monotonic")
+				}
+				if !data.DataPoints[0].StartTime.Equal(start) {
+					t.Errorf("start time = %s, want %s", data.DataPoints[0].StartTime, start)
+				}
+				dp = data.DataPoints[0]
+			default:
+				t.Fatalf("unexpected data type %T", m.Data)
+			}
+			if dp.Value != tt.wantValue {
+				t.Errorf("value = %g, want %g", dp.Value, tt.wantValue)
+			}
+			if v, _ := dp.Attributes.Value("category"); v.AsString() != tt.wantLabel {
+				t.Errorf("category = %q, want %q", v.AsString(), tt.wantLabel)
+			}
+		})
+	}
+}
+
+func TestOTLPHistogramPoint(t *testing.T) {
+	bucket := func(upper float64, count uint64) *dto.Bucket {
+		return &dto.Bucket{UpperBound: &upper, CumulativeCount: &count}
+	}
+	tests := []struct {
+		name string
+		count uint64
+		buckets []*dto.Bucket
+		wantBounds []float64
+		wantCounts []uint64
+	}{
+		{
+			name: "buckets",
+			count: 7,
+			buckets: []*dto.Bucket{bucket(0.1, 1), bucket(0.2, 1), bucket(0.5, 4), bucket(1, 6)},
+			wantBounds: []float64{0.1, 0.2, 0.5, 1},
+			wantCounts: []uint64{1, 0, 3, 2, 1},
+		},
+		{
+			name: "explicit +Inf",
+			count: 3,
+			buckets: []*dto.Bucket{bucket(1, 2), bucket(math.Inf(+1), 3)},
+			wantBounds: []float64{1},
+			wantCounts: []uint64{2, 1},
+		},
+		{
+			name: "empty",
+			wantCounts: []uint64{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sum := 1.5
+			dp := otlpHistogramPoint(&dto.Histogram{SampleCount: &tt.count, SampleSum: &sum, Bucket: tt.buckets})
+			if dp.Count != tt.count || dp.Sum != sum {
+				t.Errorf("count, sum = %d, %g; want %d, %g", dp.Count, dp.Sum, tt.count, sum)
+			}
+			if !reflect.DeepEqual(dp.Bounds, tt.wantBounds) {
+				t.Errorf("bounds = %v, want %v", dp.Bounds, tt.wantBounds)
+			}
+			if !reflect.DeepEqual(dp.BucketCounts, tt.wantCounts) {
+				t.Errorf("bucket counts = %v, want %v", dp.BucketCounts, tt.wantCounts)
+			}
+		})
+	}
+}
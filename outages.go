@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultOutagesDebounce = "5s"
+
+	outagesStateKey = "outages"
+)
+
+type OutagesConfig struct {
+	Debounce time.Duration `yaml:"debounce"`
+}
+
+func checkOutagesConfig(c *OutagesConfig) {
+	if c.Debounce < 0 {
+		log.Fatal("outages.debounce must not be negative")
+	}
+}
+
+// outagesState is saved across restarts.
+type outagesState struct {
+	Count int `json:"count"`
+	// Total time off-grid for all completed outages
+	Seconds float64 `json:"seconds"`
+	// When the current outage started (zero if the grid is up)
+	CurrentStart time.Time `json:"current_start"`
+	LastStart time.Time `json:"last_start"`
+	LastEnd time.Time `json:"last_end"`
+}
+
+// outageTracker turns changes in the system island state (and the batteries'
+// off-grid flags) into a record of grid outages.  A change has to last for
+// the debounce time before we believe it, so brief transitional states don't
+// get counted as outages (or as the end of one).
+type outageTracker struct {
+	config *OutagesConfig
+	store *stateStore
+	mu sync.Mutex
+	state outagesState
+	pending time.Time
+	latest time.Time
+}
+
+func newOutageTracker(c *powerwallCollector, oc *OutagesConfig, store *stateStore) *outageTracker {
+	c.newDesc("grid_outages_total", "Number of grid outages", nil)
+	c.newDesc("grid_outage_seconds_total", "Total time spent off-grid", nil)
+	c.newDesc("grid_outage_current_seconds", "How long the current grid outage has lasted (zero if the grid is up)", nil)
+	c.newDesc("grid_outage_last_start_timestamp_seconds", "Start time of the most recent grid outage", nil)
+	c.newDesc("grid_outage_last_end_timestamp_seconds", "End time of the most recent completed grid outage", nil)
+	t := &outageTracker{config: oc, store: store}
+	if store.get(outagesStateKey, &t.state) {
+		log.WithFields(log.Fields{"count": t.state.Count}).Info("Restored grid outage history")
+	}
+	return t
+}
+
+// offGrid returns true if the snapshot shows the system running without the
+// grid.
+func offGrid(snap *Snapshot) bool {
+	state := snap.SystemStatus.SystemIslandState
+	if state != "" && state != "SystemGridConnected" {
+		return true
+	}
+	for _, block := range snap.SystemStatus.BatteryBlocks {
+		if block.OffGrid {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *outageTracker) update(snap *Snapshot) {
+	if snap.SystemStatus == nil {
+		return
+	}
+	now := snap.Time
+	off := offGrid(snap)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &t.state
+	t.latest = now
+	inOutage := !s.CurrentStart.IsZero()
+	if off == inOutage {
+		t.pending = time.Time{}
+		return
+	}
+	if t.pending.IsZero() {
+		t.pending = now
+	}
+	if now.Sub(t.pending) < t.config.Debounce {
+		return
+	}
+
+	// The change has stuck.  Date it from when we first saw it.
+	if off {
+		s.Count++
+		s.CurrentStart = t.pending
+		s.LastStart = t.pending
+		log.WithFields(log.Fields{"island_state": snap.SystemStatus.SystemIslandState}).Warn("Grid outage started")
+	} else {
+		duration := t.pending.Sub(s.CurrentStart)
+		s.Seconds += duration.Seconds()
+		s.LastEnd = t.pending
+		s.CurrentStart = time.Time{}
+		log.WithFields(log.Fields{"duration": duration}).Warn("Grid outage ended")
+	}
+	t.pending = time.Time{}
+	t.store.set(outagesStateKey, s)
+}
+
+func (t *outageTracker) collect(c *powerwallCollector, ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &t.state
+	current := 0.0
+	if !s.CurrentStart.IsZero() && t.latest.After(s.CurrentStart) {
+		current = t.latest.Sub(s.CurrentStart).Seconds()
+	}
+	c.setCounter64(ch, "grid_outages_total", float64(s.Count))
+	c.setCounter64(ch, "grid_outage_seconds_total", s.Seconds + current)
+	c.setGauge64(ch, "grid_outage_current_seconds", current)
+	if !s.LastStart.IsZero() {
+		c.setGauge64(ch, "grid_outage_last_start_timestamp_seconds", float64(s.LastStart.Unix()))
+	}
+	if !s.LastEnd.IsZero() {
+		c.setGauge64(ch, "grid_outage_last_end_timestamp_seconds", float64(s.LastEnd.Unix()))
+	}
+}
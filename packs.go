@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const packsStateKey = "battery_packs"
+
+// packsState is saved across restarts.
+type packsState struct {
+	// The most batteries we have ever seen at once
+	MaxCount int `json:"max_count"`
+	// The serial numbers of the batteries we saw last time
+	Serials []string `json:"serials"`
+}
+
+// packTracker watches for batteries disappearing from (or appearing in) the
+// system status, and reports how evenly balanced the batteries are.
+type packTracker struct {
+	config *BatteriesConfig
+	store *stateStore
+	mu sync.Mutex
+	state packsState
+	present int
+	remainingSpread float64
+	voltageSpread float64
+	haveSpread bool
+}
+
+func newPackTracker(c *powerwallCollector, bc *BatteriesConfig, store *stateStore) *packTracker {
+	c.newDesc("battery_blocks_expected", "Number of batteries expected to be present (configured or learned)", nil)
+	c.newDesc("battery_blocks_missing", "Number of expected batteries not reported by the gateway", nil)
+	c.newDesc("battery_remaining_ratio_spread", "Difference between the highest and lowest state of energy of any two batteries", nil)
+	c.newDesc("battery_voltage_spread_volts", "Difference between the highest and lowest output voltage of any two batteries", nil)
+	t := &packTracker{config: bc, store: store}
+	if store.get(packsStateKey, &t.state) {
+		log.WithFields(log.Fields{"max_count": t.state.MaxCount, "serials": t.state.Serials}).Info("Restored battery pack state")
+	}
+	return t
+}
+
+func (t *packTracker) expected() int {
+	if t.config.ExpectedBatteries > 0 {
+		return t.config.ExpectedBatteries
+	}
+	return t.state.MaxCount
+}
+
+func (t *packTracker) update(snap *Snapshot) {
+	if snap.SystemStatus == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	serials := []string{}
+	minRemaining, maxRemaining := math.Inf(1), math.Inf(-1)
+	minVolts, maxVolts := math.Inf(1), math.Inf(-1)
+	for _, block := range snap.SystemStatus.BatteryBlocks {
+		serials = append(serials, block.PackageSerialNumber)
+		if block.NominalFullPackEnergy > 0 {
+			r := float64(block.NominalEnergyRemaining / block.NominalFullPackEnergy)
+			minRemaining = math.Min(minRemaining, r)
+			maxRemaining = math.Max(maxRemaining, r)
+		}
+		minVolts = math.Min(minVolts, float64(block.VOut))
+		maxVolts = math.Max(maxVolts, float64(block.VOut))
+	}
+	sort.Strings(serials)
+	t.present = len(serials)
+	t.haveSpread = len(serials) > 1 && !math.IsInf(minRemaining, 1)
+	if t.haveSpread {
+		t.remainingSpread = maxRemaining - minRemaining
+		t.voltageSpread = maxVolts - minVolts
+	}
+
+	changed := false
+	if t.state.Serials != nil {
+		seen := make(map[string]bool)
+		for _, s := range serials {
+			seen[s] = true
+		}
+		for _, s := range t.state.Serials {
+			if !seen[s] {
+				log.WithFields(log.Fields{"serial": s}).Warn("Battery is no longer being reported by the gateway")
+			}
+			delete(seen, s)
+		}
+		for s := range seen {
+			log.WithFields(log.Fields{"serial": s}).Warn("New battery is being reported by the gateway")
+		}
+		changed = len(seen) > 0 || len(serials) != len(t.state.Serials)
+	} else {
+		changed = true
+	}
+	if changed {
+		t.state.Serials = serials
+	}
+	if len(serials) > t.state.MaxCount {
+		t.state.MaxCount = len(serials)
+		changed = true
+	}
+	if changed {
+		t.store.set(packsStateKey, &t.state)
+	}
+}
+
+func (t *packTracker) collect(c *powerwallCollector, ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state.Serials == nil {
+		return
+	}
+	expected := t.expected()
+	c.setGauge64(ch, "battery_blocks_expected", float64(expected))
+	c.setGauge64(ch, "battery_blocks_missing", math.Max(float64(expected - t.present), 0))
+	if t.haveSpread {
+		c.setGauge64(ch, "battery_remaining_ratio_spread", t.remainingSpread)
+		c.setGauge64(ch, "battery_voltage_spread_volts", t.voltageSpread)
+	}
+}
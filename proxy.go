@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/foogod/go-powerwall"
+)
+
+const defaultProxyTTL = "5s"
+
+// The gateway API paths which are proxied if the config file doesn't list
+// any, along with how long responses are cached for each.  (These are all
+// read-only, and don't include anything like login or config endpoints.)
+var defaultProxyPaths = map[string]string{
+	"status": "60s",
+	"site_info": "300s",
+	"site_info/site_name": "300s",
+	"sitemaster": "30s",
+	"operation": "60s",
+	"networks": "60s",
+	"powerwalls": "60s",
+	"solars": "300s",
+	"troubleshooting/problems": "60s",
+	"system_status": "5s",
+	"system_status/soe": "5s",
+	"system_status/grid_status": "5s",
+	"system_status/grid_faults": "30s",
+	"meters/aggregates": "5s",
+	"meters/site": "5s",
+	"meters/solar": "5s",
+	"meters/battery": "5s",
+	"meters/load": "5s",
+}
+
+// Fields which are removed from any proxied responses which contain them.  The
+// meters APIs include the TLS keys and certs the gateway uses to talk to each
+// meter, which we certainly don't want to hand out to anybody who asks.
+var proxyRedactedFields = map[string]bool{
+	"client_key": true,
+	"client_cert": true,
+	"server_ca_cert": true,
+}
+
+type ProxyConfig struct {
+	DefaultTTL time.Duration `yaml:"default_ttl"`
+	Paths map[string]time.Duration `yaml:"paths"`
+}
+
+func setProxyDefaults(c *ProxyConfig) {
+	if c.DefaultTTL == 0 {
+		c.DefaultTTL, _ = time.ParseDuration(defaultProxyTTL)
+	}
+	if c.Paths == nil {
+		c.Paths = make(map[string]time.Duration)
+		for path, ttl := range defaultProxyPaths {
+			c.Paths[path], _ = time.ParseDuration(ttl)
+		}
+	}
+	for path, ttl := range c.Paths {
+		if ttl == 0 {
+			c.Paths[path] = c.DefaultTTL
+		}
+	}
+}
+
+func checkProxyConfig(c *ProxyConfig) {
+	if c.DefaultTTL < 0 {
+		log.Fatal("proxy.default_ttl must not be negative")
+	}
+	for path, ttl := range c.Paths {
+		if ttl < 0 {
+			log.Fatalf("TTL for proxy path %q must not be negative", path)
+		}
+		if strings.HasPrefix(strings.Trim(path, "/"), "login") {
+			// We'd be handing out our own auth token to anybody
+			// who asked.
+			log.Fatalf("Proxy path %q is not allowed", path)
+		}
+	}
+}
+
+// A proxyEntry holds the cached response for a single gateway request.  Its
+// mutex is held while fetching, so if several clients ask for the same thing
+// at once, only one request is actually sent to the gateway.
+type proxyEntry struct {
+	mu sync.Mutex
+	time time.Time
+	body []byte
+	contentType string
+}
+
+// A gatewayProxy serves (a configured subset of) the gateway's own API, using
+// the exporter's authenticated session and caching responses, so that other
+// tools can get at the same data without logging in to the gateway
+// themselves.  It is strictly read-only.
+type gatewayProxy struct {
+	config *ProxyConfig
+	gw *gatewayClient
+	mu sync.Mutex
+	cache map[string]*proxyEntry
+}
+
+func newGatewayProxy(c *ProxyConfig, gw *gatewayClient) *gatewayProxy {
+	return &gatewayProxy{
+		config: c,
+		gw: gw,
+		cache: make(map[string]*proxyEntry),
+	}
+}
+
+func (p *gatewayProxy) entry(key string) *proxyEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.cache[key]
+	if !ok {
+		e = &proxyEntry{}
+		p.cache[key] = e
+	}
+	return e
+}
+
+// ServeHTTP handles requests for "/api/<path>", which are answered from the
+// cache if possible, or passed on to the gateway if not.
+func (p *gatewayProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/")
+	ttl, ok := p.config.Paths[path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// Query strings are not passed on.  None of the read-only APIs use
+	// them, and if we cached a separate response for each one, anybody
+	// could make the cache grow as large as they liked.
+	logger := log.WithFields(log.Fields{"path": path, "remote": r.RemoteAddr})
+
+	e := p.entry(path)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.body == nil || time.Since(e.time) > ttl {
+		logger.Debug("Proxy cache miss.  Fetching from gateway...")
+		ctx, span := startGatewaySpan(r.Context(), "Proxy " + path)
+		body, contentType, err := p.gw.get(ctx, path)
+		endGatewaySpan(span, err)
+		if err != nil {
+			logger.WithFields(log.Fields{"err": err}).Warn("Error fetching proxied API from gateway")
+			switch err := err.(type) {
+			case powerwall.ApiError:
+				// Pass the gateway's own error response on
+				// as-is.
+				w.WriteHeader(err.StatusCode)
+				w.Write(err.Body)
+			case net.Error:
+				http.Error(w, "Timed out talking to gateway", http.StatusGatewayTimeout)
+			default:
+				http.Error(w, "Error talking to gateway", http.StatusBadGateway)
+			}
+			return
+		}
+		e.time = time.Now()
+		e.body = redactProxyResponse(body)
+		e.contentType = contentType
+	}
+
+	if e.contentType != "" {
+		w.Header().Set("Content-Type", e.contentType)
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(e.time).Seconds())))
+	w.Write(e.body)
+}
+
+// redactProxyResponse removes any proxyRedactedFields from a JSON response
+// body.  If there aren't any (or it isn't JSON), the body is returned
+// unchanged.
+func redactProxyResponse(body []byte) []byte {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	// Keep numbers exactly as the gateway sent them
+	dec.UseNumber()
+	var v interface{}
+	if dec.Decode(&v) != nil {
+		return body
+	}
+	if !redactFields(v) {
+		return body
+	}
+	redacted, err := json.Marshal(v)
+	if err != nil {
+		// Better to send nothing than to send the secrets
+		return []byte("{}")
+	}
+	return redacted
+}
+
+// redactFields removes proxyRedactedFields from any objects found anywhere in
+// v, returning true if it removed anything.
+func redactFields(v interface{}) bool {
+	removed := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if proxyRedactedFields[k] {
+				delete(v, k)
+				removed = true
+			} else if redactFields(child) {
+				removed = true
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if redactFields(child) {
+				removed = true
+			}
+		}
+	}
+	return removed
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetProxyDefaults(t *testing.T) {
+	tests := []struct {
+		name string
+		config ProxyConfig
+		path string
+		want time.Duration // -1 if the path shouldn't be proxied
+	}{
+		{"default paths", ProxyConfig{}, "meters/aggregates", 5 * time.Second},
+		{"default slow path", ProxyConfig{}, "site_info", 300 * time.Second},
+		{"default excludes login", ProxyConfig{}, "login/Basic", -1},
+		{"configured", ProxyConfig{Paths: map[string]time.Duration{"status": time.Minute}}, "status", time.Minute},
+		{"configured replaces defaults", ProxyConfig{Paths: map[string]time.Duration{"status": time.Minute}}, "meters/aggregates", -1},
+		{"default ttl", ProxyConfig{Paths: map[string]time.Duration{"status": 0}}, "status", 5 * time.Second},
+		{"configured default ttl", ProxyConfig{DefaultTTL: time.Second, Paths: map[string]time.Duration{"status": 0}}, "status", time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.config
+			setProxyDefaults(&c)
+			got, ok := c.Paths[tt.path]
+			if !ok {
+				got = -1
+			}
+			if got != tt.want {
+				t.Errorf("ttl for %q = %s, want %s", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGatewayProxyRejects(t *testing.T) {
+	c := &ProxyConfig{}
+	setProxyDefaults(c)
+	// There's no gateway, so anything which gets past the checks will
+	// crash the test.
+	p := newGatewayProxy(c, nil)
+	tests := []struct {
+		name string
+		method string
+		path string
+		want int
+	}{
+		{"post", http.MethodPost, "/api/status", http.StatusMethodNotAllowed},
+		{"put", http.MethodPut, "/api/operation", http.StatusMethodNotAllowed},
+		{"delete", http.MethodDelete, "/api/status", http.StatusMethodNotAllowed},
+		{"unknown path", http.MethodGet, "/api/config", http.StatusNotFound},
+		{"login", http.MethodGet, "/api/login/Basic", http.StatusNotFound},
+		{"prefix of a path", http.MethodGet, "/api/meters", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.want {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.path, w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactProxyResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "meters",
+			body: `[{"id":0,"connection":{"device_serial":"VAH1","https_conf":{"client_cert":"CERT","client_key":"KEY","server_ca_cert":"CA","max_idle_conns_per_host":1}},"Cached_readings":{"instant_power":-1.2345678901234}}]`,
+			want: `[{"Cached_readings":{"instant_power":-1.2345678901234},"connection":{"device_serial":"VAH1","https_conf":{"max_idle_conns_per_host":1}},"id":0}]`,
+		},
+		{
+			name: "nothing to redact",
+			body: `{"percentage": 69.1, "b": [1, 2]}`,
+			want: `{"percentage": 69.1, "b": [1, 2]}`,
+		},
+		{
+			name: "not json",
+			body: `<html>client_key</html>`,
+			want: `<html>client_key</html>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(redactProxyResponse([]byte(tt.body)))
+			if strings.Contains(got, "KEY") || strings.Contains(got, "CERT") {
+				t.Errorf("secrets not removed: %s", got)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGatewayClientCancel(t *testing.T) {
+	// Nothing is listening on this address, so every attempt fails with
+	// a network error and would otherwise be retried until RetryTimeout.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &url.URL{Scheme: "https", Host: l.Addr().String(), Path: "api/status"}
+	l.Close()
+
+	saved := config.Device
+	config.Device.RetryTimeout = time.Minute
+	config.Device.RetryInterval = 100 * time.Millisecond
+	t.Cleanup(func() { config.Device = saved })
+
+	g := &gatewayClient{}
+	ctx, cancel := context.WithTimeout(context.Background(), 300 * time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = g.do(ctx, u, "")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5 * time.Second {
+		t.Errorf("do returned after %s, want it to stop when ctx is done", elapsed)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultRatiosWindow = "24h"
+
+// We don't need a sample for every collection to work out the rolling
+// window ratios, so only keep one this often (which keeps memory use sane
+// with short poll intervals).
+const ratioSampleInterval = time.Minute
+
+type RatiosConfig struct {
+	Window time.Duration `yaml:"window"`
+}
+
+func checkRatiosConfig(c *RatiosConfig) {
+	if c.Window <= 0 {
+		log.Fatal("ratios.window must be greater than zero")
+	}
+}
+
+// An energySample holds the lifetime energy counters (in Wh) from the meter
+// aggregates at a particular time.
+type energySample struct {
+	time time.Time
+	loadImported float64
+	siteImported float64
+	siteExported float64
+	solarExported float64
+	batteryImported float64
+	batteryExported float64
+}
+
+func newEnergySample(snap *Snapshot) (energySample, bool) {
+	site, ok1 := snap.Aggregates["site"]
+	solar, ok2 := snap.Aggregates["solar"]
+	battery, ok3 := snap.Aggregates["battery"]
+	load, ok4 := snap.Aggregates["load"]
+	if !(ok1 && ok2 && ok3 && ok4) {
+		return energySample{}, false
+	}
+	if load.EnergyImported == 0 {
+		// The gateway sometimes reports zero for all of its
+		// counters for a while when starting up.  The home has
+		// always used some energy, so this can't be real (unlike
+		// zero solar production, for example, which just means
+		// there's no solar).
+		return energySample{}, false
+	}
+	return energySample{
+		time: snap.Time,
+		loadImported: float64(load.EnergyImported),
+		siteImported: float64(site.EnergyImported),
+		siteExported: float64(site.EnergyExported),
+		solarExported: float64(solar.EnergyExported),
+		batteryImported: float64(battery.EnergyImported),
+		batteryExported: float64(battery.EnergyExported),
+	}, true
+}
+
+// ratiosSince works out the self-powered and solar self-consumption ratios
+// for the energy used between the start sample and this one.  Either result
+// is NaN if there wasn't anything to compute it from (no load, or no solar
+// production, respectively).
+func (s energySample) ratiosSince(start energySample) (selfPowered, selfConsumption float64) {
+	load := s.loadImported - start.loadImported
+	solar := s.solarExported - start.solarExported
+	imported := s.siteImported - start.siteImported
+	exported := s.siteExported - start.siteExported
+	charged := s.batteryImported - start.batteryImported
+
+	// As with the energy flows, assume that any exported energy came
+	// from solar first, and that the battery was charged from whatever
+	// solar was left over before using the grid.  Whatever else was
+	// imported from the grid went to the home.
+	solarExported := math.Min(exported, solar)
+	gridCharged := math.Min(math.Max(charged - (solar - solarExported), 0), imported)
+	gridToHome := imported - gridCharged
+
+	selfPowered, selfConsumption = math.NaN(), math.NaN()
+	if load > 0 {
+		selfPowered = clampRatio(1 - gridToHome / load)
+	}
+	if solar > 0 {
+		selfConsumption = clampRatio(1 - solarExported / solar)
+	}
+	return
+}
+
+// zeroReading returns true if any of the counters which were non-zero in the
+// earlier sample are now reading zero.  That's the gateway not reporting
+// proper values yet (see newEnergySample), not a real reset, so samples like
+// this should just be skipped.
+func (s energySample) zeroReading(earlier energySample) bool {
+	return (s.loadImported == 0 && earlier.loadImported != 0) ||
+		(s.siteImported == 0 && earlier.siteImported != 0) ||
+		(s.siteExported == 0 && earlier.siteExported != 0) ||
+		(s.solarExported == 0 && earlier.solarExported != 0) ||
+		(s.batteryImported == 0 && earlier.batteryImported != 0) ||
+		(s.batteryExported == 0 && earlier.batteryExported != 0)
+}
+
+// counterReset returns true if any of the counters have gone backwards since
+// the earlier sample (which means the gateway has reset them).
+func (s energySample) counterReset(earlier energySample) bool {
+	return s.loadImported < earlier.loadImported ||
+		s.siteImported < earlier.siteImported ||
+		s.siteExported < earlier.siteExported ||
+		s.solarExported < earlier.solarExported ||
+		s.batteryImported < earlier.batteryImported ||
+		s.batteryExported < earlier.batteryExported
+}
+
+func clampRatio(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// ratioTracker calculates what proportion of the home's energy use was not
+// supplied by the grid ("self-powered"), and what proportion of solar
+// production was used on site instead of being exported ("self-consumption"),
+// over the last collection interval, since midnight (in the site timezone),
+// and over a rolling window.
+type ratioTracker struct {
+	config *RatiosConfig
+	mu sync.Mutex
+	previous *energySample
+	latest *energySample
+	today *energySample
+	samples []energySample
+}
+
+func newRatioTracker(c *powerwallCollector, rc *RatiosConfig) *ratioTracker {
+	c.newDesc("self_powered_ratio", "Proportion of home energy use not supplied by the grid", []string{"period"})
+	c.newDesc("solar_self_consumption_ratio", "Proportion of solar energy produced which was used on site (not exported)", []string{"period"})
+	return &ratioTracker{config: rc}
+}
+
+func (t *ratioTracker) update(snap *Snapshot) {
+	s, ok := newEnergySample(snap)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.latest != nil && s.zeroReading(*t.latest) {
+		return
+	}
+	if t.latest != nil && s.counterReset(*t.latest) {
+		log.Info("Meter energy counters have been reset.  Restarting self-powered/self-consumption ratios.")
+		t.latest = nil
+		t.today = nil
+		t.samples = nil
+	}
+	t.previous = t.latest
+	t.latest = &s
+
+	y, m, d := s.time.In(config.Site.location).Date()
+	if t.today != nil {
+		ty, tm, td := t.today.time.In(config.Site.location).Date()
+		if y != ty || m != tm || d != td {
+			// A new day has started.  The last sample from
+			// yesterday (if we have one) is the best baseline we
+			// have for the start of today.
+			if t.previous != nil {
+				t.today = t.previous
+			} else {
+				t.today = nil
+			}
+		}
+	}
+	if t.today == nil {
+		t.today = &s
+	}
+
+	if len(t.samples) == 0 || s.time.Sub(t.samples[len(t.samples) - 1].time) >= ratioSampleInterval {
+		t.samples = append(t.samples, s)
+	}
+	// Keep the last sample from before the start of the window, so the
+	// window is always fully covered if we have enough history.
+	start := s.time.Add(-t.config.Window)
+	for len(t.samples) > 1 && !t.samples[1].time.After(start) {
+		t.samples = t.samples[1:]
+	}
+}
+
+func (t *ratioTracker) collect(c *powerwallCollector, ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.latest == nil {
+		return
+	}
+	set := func(period string, start *energySample) {
+		if start == nil {
+			return
+		}
+		selfPowered, selfConsumption := t.latest.ratiosSince(*start)
+		if !math.IsNaN(selfPowered) {
+			c.setGauge64(ch, "self_powered_ratio", selfPowered, period)
+		}
+		if !math.IsNaN(selfConsumption) {
+			c.setGauge64(ch, "solar_self_consumption_ratio", selfConsumption, period)
+		}
+	}
+	set("current", t.previous)
+	set("today", t.today)
+	set("window", &t.samples[0])
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+)
+
+// newTestCollector returns a collector which is good enough for constructing
+// extensions in tests (it never talks to a gateway).
+func newTestCollector(t *testing.T) *powerwallCollector {
+	t.Helper()
+	if config.Site.location == nil {
+		config.Site.location = time.UTC
+	}
+	return NewPowerwallCollector(nil)
+}
+
+// energySnapshot returns a snapshot with all of the meter aggregates filled in
+// with the given lifetime counters (in Wh).
+func energySnapshot(when time.Time, s energySample) *Snapshot {
+	return &Snapshot{
+		Time: when,
+		Aggregates: map[string]powerwall.MeterAggregatesData{
+			"load": {EnergyImported: float32(s.loadImported)},
+			"site": {EnergyImported: float32(s.siteImported), EnergyExported: float32(s.siteExported)},
+			"solar": {EnergyExported: float32(s.solarExported)},
+			"battery": {EnergyImported: float32(s.batteryImported), EnergyExported: float32(s.batteryExported)},
+		},
+	}
+}
+
+func TestRatiosSince(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name string
+		delta energySample // change in each counter
+		wantSelfPowered float64
+		wantSelfConsumption float64
+	}{
+		{"nothing", energySample{}, nan, nan},
+		{"grid only", energySample{loadImported: 10, siteImported: 10}, 0, nan},
+		{"solar only", energySample{loadImported: 10, solarExported: 10}, 1, 1},
+		{"solar and grid", energySample{loadImported: 10, solarExported: 4, siteImported: 6}, 0.4, 1},
+		{"solar exported", energySample{loadImported: 10, solarExported: 20, siteExported: 10}, 1, 0.5},
+		{"solar charges battery", energySample{loadImported: 5, solarExported: 10, batteryImported: 5}, 1, 1},
+		{"grid charges battery", energySample{loadImported: 10, siteImported: 15, batteryImported: 5}, 0, nan},
+	}
+	start := energySample{loadImported: 500000, siteImported: 300000, siteExported: 100000, solarExported: 400000, batteryImported: 50000}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			end := start
+			end.loadImported += tt.delta.loadImported
+			end.siteImported += tt.delta.siteImported
+			end.siteExported += tt.delta.siteExported
+			end.solarExported += tt.delta.solarExported
+			end.batteryImported += tt.delta.batteryImported
+			selfPowered, selfConsumption := end.ratiosSince(start)
+			same := func(got, want float64) bool {
+				return (math.IsNaN(got) && math.IsNaN(want)) || math.Abs(got - want) < 1e-9
+			}
+			if !same(selfPowered, tt.wantSelfPowered) || !same(selfConsumption, tt.wantSelfConsumption) {
+				t.Errorf("ratios = %g, %g; want %g, %g", selfPowered, selfConsumption, tt.wantSelfPowered, tt.wantSelfConsumption)
+			}
+		})
+	}
+}
+
+func TestRatioTracker(t *testing.T) {
+	// Over its lifetime, this site is 40% self-powered and consumes 75%
+	// of its solar.  Each step adds 10 Wh of load (all from the grid) and
+	// 20 Wh of solar (all exported), so the recent ratios are both zero.
+	lifetime := energySample{
+		loadImported: 500000,
+		siteImported: 300000,
+		siteExported: 100000,
+		solarExported: 400000,
+		batteryImported: 50000,
+	}
+	step := func(n int) energySample {
+		s := lifetime
+		s.loadImported += float64(10 * n)
+		s.siteImported += float64(10 * n)
+		s.solarExported += float64(20 * n)
+		s.siteExported += float64(20 * n)
+		return s
+	}
+	zero := energySample{}
+	tests := []struct {
+		name string
+		samples []energySample
+	}{
+		{"steady", []energySample{step(0), step(1), step(2)}},
+		{"zero reading", []energySample{step(0), step(1), zero, step(2)}},
+		{"zero at start", []energySample{zero, step(0), step(1), step(2)}},
+		{"one counter zero", []energySample{step(0), step(1), func() energySample { s := step(2); s.siteExported = 0; return s }(), step(2)}},
+	}
+	start := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newRatioTracker(newTestCollector(t), &RatiosConfig{Window: time.Hour})
+			for i, s := range tt.samples {
+				tracker.update(energySnapshot(start.Add(time.Duration(i) * time.Minute), s))
+			}
+			periods := map[string]*energySample{
+				"current": tracker.previous,
+				"today": tracker.today,
+				"window": &tracker.samples[0],
+			}
+			for period, since := range periods {
+				if since == nil {
+					t.Errorf("no %s baseline", period)
+					continue
+				}
+				selfPowered, selfConsumption := tracker.latest.ratiosSince(*since)
+				if math.Abs(selfPowered) > 1e-9 || math.Abs(selfConsumption) > 1e-9 {
+					t.Errorf("%s ratios = %g, %g; want 0, 0", period, selfPowered, selfConsumption)
+				}
+			}
+		})
+	}
+}
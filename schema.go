@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/foogod/go-powerwall"
+)
+
+const defaultSchemaCheckInterval = "1h"
+
+type SchemaConfig struct {
+	CheckInterval time.Duration `yaml:"check_interval"`
+}
+
+func checkSchemaConfig(c *SchemaConfig) {
+	if c.CheckInterval < 0 {
+		log.Fatal("schema.check_interval must not be negative")
+	}
+}
+
+// schemaTypes maps each API path we fetch to the type go-powerwall decodes it
+// into (plus anything extra we decode ourselves).  (The individual
+// "meters/<category>" paths are added separately, as we don't know what
+// categories there are until we've seen the aggregates.)
+var schemaTypes = map[string]reflect.Type{
+	"status": reflect.TypeOf(powerwall.StatusData{}),
+	"system_status/soe": reflect.TypeOf(powerwall.SOEData{}),
+	"operation": reflect.TypeOf(powerwall.OperationData{}),
+	"sitemaster": reflect.TypeOf(powerwall.SitemasterData{}),
+	"troubleshooting/problems": reflect.TypeOf(powerwall.TroubleshootingProblemsData{}),
+	"system_status": extendType(reflect.TypeOf(powerwall.SystemStatusData{}), []string{"BatteryBlocks"}, reflect.TypeOf(batteryBlockLimits{})),
+	"meters/aggregates": reflect.TypeOf(map[string]powerwall.MeterAggregatesData{}),
+	"networks": reflect.TypeOf([]powerwall.NetworkData{}),
+}
+
+// extendType returns a type like t, except that the struct found by following
+// the named fields in path (through any slices along the way) also has all of
+// the fields of extra.  This lets us describe responses which we decode into
+// go-powerwall's types, and then again for extra fields (see getSystemStatus
+// and getMeters).
+func extendType(t reflect.Type, path []string, extra reflect.Type) reflect.Type {
+	switch t.Kind() {
+	case reflect.Slice:
+		return reflect.SliceOf(extendType(t.Elem(), path, extra))
+	case reflect.Struct:
+		fields := []reflect.StructField{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if len(path) > 0 && f.Name == path[0] {
+				f.Type = extendType(f.Type, path[1:], extra)
+			}
+			fields = append(fields, f)
+		}
+		if len(path) == 0 {
+			for i := 0; i < extra.NumField(); i++ {
+				fields = append(fields, extra.Field(i))
+			}
+		}
+		return reflect.StructOf(fields)
+	}
+	return t
+}
+
+var meterSchemaType = extendType(reflect.TypeOf([]powerwall.MeterData{}), []string{"CachedReadings"}, reflect.TypeOf(meterExtraReadings{}))
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// schemaDiff holds the fields which differ between an API response and the
+// struct it is decoded into, as dotted paths ("battery_blocks[].v_out").
+type schemaDiff struct {
+	unknown map[string]bool
+	missing map[string]bool
+}
+
+// compare walks a decoded JSON value alongside the Go type it would be
+// unmarshalled into, noting any object keys the type doesn't have a field
+// for, and any fields which the JSON doesn't contain.
+func (d *schemaDiff) compare(value interface{}, t reflect.Type, path string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if value == nil || reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		// Types with their own decoding (times, durations, etc) are
+		// opaque as far as we're concerned.
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		fields := make(map[string]reflect.Type)
+		jsonFields(t, fields)
+		for key, v := range obj {
+			ft, ok := fields[key]
+			if !ok {
+				d.unknown[path + key] = true
+				continue
+			}
+			d.compare(v, ft, path + key + ".")
+		}
+		for name := range fields {
+			if _, ok := obj[name]; !ok {
+				d.missing[path + name] = true
+			}
+		}
+	case reflect.Map:
+		if obj, ok := value.(map[string]interface{}); ok {
+			for _, v := range obj {
+				d.compare(v, t.Elem(), path + "*.")
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if list, ok := value.([]interface{}); ok {
+			prefix := strings.TrimSuffix(path, ".") + "[]."
+			for _, v := range list {
+				d.compare(v, t.Elem(), prefix)
+			}
+		}
+	}
+}
+
+// jsonFields collects the JSON names of a struct type's fields (the same way
+// encoding/json does, more or less), along with their types.
+func jsonFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				jsonFields(ft, fields)
+				continue
+			}
+		}
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A schemaChecker periodically fetches the raw responses for each API we use,
+// and compares them against what go-powerwall expects, so we can tell when a
+// gateway software update has changed the API out from under us.
+type schemaChecker struct {
+	config *SchemaConfig
+	gateway *gatewayClient
+	mu sync.Mutex
+	running bool
+	lastCheck time.Time
+	// When the last check actually finished
+	checked time.Time
+	version string
+	categories []string
+	unknown map[string]int
+	missing map[string]int
+	// The differences already logged for each endpoint, so we only
+	// complain about each one once.
+	reported map[string]bool
+}
+
+func newSchemaChecker(c *powerwallCollector, sc *SchemaConfig, gateway *gatewayClient) *schemaChecker {
+	c.newDesc("api_unknown_fields", "Number of fields in the gateway's API response which go-powerwall does not know about", []string{"endpoint"})
+	c.newDesc("api_missing_fields", "Number of fields go-powerwall expects which are missing from the gateway's API response", []string{"endpoint"})
+	c.newDesc("api_schema_check_timestamp_seconds", "Time the gateway's API responses were last checked against go-powerwall's", nil)
+	return &schemaChecker{
+		config: sc,
+		gateway: gateway,
+		unknown: make(map[string]int),
+		missing: make(map[string]int),
+		reported: make(map[string]bool),
+	}
+}
+
+func (s *schemaChecker) update(snap *Snapshot) {
+	if s.config.CheckInterval == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	version := s.version
+	if snap.Status != nil {
+		version = snap.Status.Version
+	}
+	if snap.Aggregates != nil {
+		s.categories = s.categories[:0]
+		for cat := range snap.Aggregates {
+			s.categories = append(s.categories, cat)
+		}
+		sort.Strings(s.categories)
+	}
+	due := s.lastCheck.IsZero() || snap.Time.Sub(s.lastCheck) >= s.config.CheckInterval || version != s.version
+	if s.running || !due {
+		return
+	}
+	// This makes a whole extra set of requests to the gateway, so we do
+	// it in the background rather than holding up everything else.
+	s.running = true
+	s.version = version
+	s.lastCheck = snap.Time
+	apis := make(map[string]reflect.Type)
+	for api, t := range schemaTypes {
+		apis[api] = t
+	}
+	for _, cat := range s.categories {
+		apis["meters/" + cat] = meterSchemaType
+	}
+	go s.check(apis)
+}
+
+func (s *schemaChecker) check(apis map[string]reflect.Type) {
+	ctx, span := tracer.Start(context.Background(), "CheckSchema")
+	defer span.End()
+	log.WithFields(traceLogFields(ctx)).Debug("Checking gateway API responses for changes...")
+	results := make(map[string]*schemaDiff)
+	for api, t := range apis {
+		apiCtx, apiSpan := startGatewaySpan(ctx, "GET " + api)
+		body, _, err := s.gateway.get(apiCtx, api)
+		endGatewaySpan(apiSpan, err)
+		if err != nil {
+			log.WithFields(log.Fields{"api": api, "err": err}).Warn("Unable to fetch API response for schema check")
+			continue
+		}
+		var value interface{}
+		err = json.Unmarshal(body, &value)
+		if err != nil {
+			log.WithFields(log.Fields{"api": api, "err": err}).Warn("Unable to decode API response for schema check")
+			continue
+		}
+		d := &schemaDiff{unknown: make(map[string]bool), missing: make(map[string]bool)}
+		d.compare(value, t, "")
+		results[api] = d
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+	s.checked = time.Now()
+	for api, d := range results {
+		s.unknown[api] = len(d.unknown)
+		s.missing[api] = len(d.missing)
+		for _, path := range sortedKeys(d.unknown) {
+			if !s.reported["unknown/" + api + "/" + path] {
+				s.reported["unknown/" + api + "/" + path] = true
+				log.WithFields(log.Fields{"api": api, "field": path}).Warn("Gateway API response contains a field go-powerwall does not know about")
+			}
+		}
+		// Older software versions often leave out fields which newer
+		// ones have, so these are less interesting.
+		for _, path := range sortedKeys(d.missing) {
+			if !s.reported["missing/" + api + "/" + path] {
+				s.reported["missing/" + api + "/" + path] = true
+				log.WithFields(log.Fields{"api": api, "field": path}).Info("Gateway API response is missing a field go-powerwall expects")
+			}
+		}
+	}
+}
+
+func (s *schemaChecker) collect(c *powerwallCollector, ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for api, n := range s.unknown {
+		c.setGauge64(ch, "api_unknown_fields", float64(n), api)
+	}
+	for api, n := range s.missing {
+		c.setGauge64(ch, "api_missing_fields", float64(n), api)
+	}
+	if !s.checked.IsZero() {
+		c.setGauge64(ch, "api_schema_check_timestamp_seconds", float64(s.checked.Unix()))
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSchemaCompare(t *testing.T) {
+	tests := []struct {
+		name string
+		api string
+		body string
+		wantUnknown []string
+		wantMissing []string
+	}{
+		{
+			name: "system_status block limits",
+			api: "system_status",
+			body: `{"battery_blocks": [{"PackageSerialNumber": "TG1", "v_out": 240.1, "v_nominal": 230, "i_max": 20}]}`,
+		},
+		{
+			name: "system_status new field",
+			api: "system_status",
+			body: `{"nominal_full_pack_energy": 1, "battery_blocks": [{"v_out": 240.1, "new_thing": 1}], "other_thing": {"a": 1}}`,
+			wantUnknown: []string{"battery_blocks[].new_thing", "other_thing"},
+		},
+		{
+			name: "aggregates",
+			api: "meters/aggregates",
+			body: `{"site": {"instant_power": 1, "mystery": 2}, "load": {"instant_power": 3}}`,
+			wantUnknown: []string{"*.mystery"},
+		},
+		{
+			name: "meters phase C",
+			api: "meters/site",
+			body: `[{"type": "neurio_w2_tcp", "Cached_readings": {"real_power_a": 1, "real_power_c": 2, "reactive_power_c": 3, "v_l3n": 120.5, "v_l4n": 1}}]`,
+			wantUnknown: []string{"[].Cached_readings.v_l4n"},
+		},
+		{
+			name: "soe missing",
+			api: "system_status/soe",
+			body: `{}`,
+			wantMissing: []string{"percentage"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var value interface{}
+			if err := json.Unmarshal([]byte(tt.body), &value); err != nil {
+				t.Fatal(err)
+			}
+			d := &schemaDiff{unknown: make(map[string]bool), missing: make(map[string]bool)}
+			typ := schemaTypes[tt.api]
+			if typ == nil {
+				typ = meterSchemaType
+			}
+			d.compare(value, typ, "")
+			if got := sortedKeys(d.unknown); !reflect.DeepEqual(got, tt.wantUnknown) && !(len(got) == 0 && len(tt.wantUnknown) == 0) {
+				t.Errorf("unknown fields = %v, want %v", got, tt.wantUnknown)
+			}
+			if tt.wantMissing != nil {
+				if got := sortedKeys(d.missing); !reflect.DeepEqual(got, tt.wantMissing) {
+					t.Errorf("missing fields = %v, want %v", got, tt.wantMissing)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Keep UDP packets comfortably under a typical network MTU
+const maxUDPPacket = 1400
+
+// A sinkWriteFunc receives the full set of metric families gathered from the
+// registry at a particular time, and sends them on to some external system.
+type sinkWriteFunc func(families []*dto.MetricFamily, ts time.Time) error
+
+// runSink periodically gathers all metrics from the given registry and passes
+// them to the supplied write function.  This is used for "push" style outputs
+// (as opposed to Prometheus, which pulls from us).  It never returns.
+func runSink(name string, g prometheus.Gatherer, interval time.Duration, write sinkWriteFunc) {
+	log.WithFields(log.Fields{"sink": name, "interval": interval}).Info("Starting output sink")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ts := time.Now()
+		families, err := g.Gather()
+		if err != nil {
+			// Gather can return partial results along with an error,
+			// so we still try to send whatever we did get.
+			log.WithFields(log.Fields{"sink": name, "err": err}).Warn("Error gathering metrics for output sink")
+		}
+		if len(families) > 0 {
+			err = write(families, ts)
+			if err != nil {
+				log.WithFields(log.Fields{"sink": name, "err": err}).Error("Error writing metrics to output sink")
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// metricValue returns the value of a gathered metric, along with whether it
+// was of a type we know how to handle (gauges, counters, and untyped values)
+func metricValue(m *dto.Metric) (float64, bool) {
+	switch {
+	case m.Gauge != nil:
+		return m.Gauge.GetValue(), true
+	case m.Counter != nil:
+		return m.Counter.GetValue(), true
+	case m.Untyped != nil:
+		return m.Untyped.GetValue(), true
+	}
+	return 0, false
+}
+
+// metricLabels returns the labels of a gathered metric as a simple map.
+func metricLabels(m *dto.Metric) map[string]string {
+	labels := make(map[string]string, len(m.Label))
+	for _, lp := range m.Label {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	return labels
+}
+
+// writeLinesUDP sends newline-terminated lines of text to the given UDP
+// address, packing as many lines into each packet as will fit.
+func writeLinesUDP(addr string, lines []string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len() + len(line) + 1 > maxUDPPacket {
+			_, err = conn.Write(packet.Bytes())
+			if err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		packet.WriteString(line)
+		packet.WriteString("\n")
+	}
+	if packet.Len() > 0 {
+		_, err = conn.Write(packet.Bytes())
+	}
+	return err
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"github.com/foogod/go-powerwall"
+)
+
+// A Snapshot holds all of the information retrieved from the gateway during a
+// single collection.  Any parts which could not be fetched are left nil (and
+// the reason recorded in Errors).
+type Snapshot struct {
+	Time time.Time `json:"timestamp"`
+	Status *powerwall.StatusData `json:"status,omitempty"`
+	SOE *powerwall.SOEData `json:"soe,omitempty"`
+	Operation *powerwall.OperationData `json:"operation,omitempty"`
+	Sitemaster *powerwall.SitemasterData `json:"sitemaster,omitempty"`
+	Problems *powerwall.TroubleshootingProblemsData `json:"problems,omitempty"`
+	SystemStatus *powerwall.SystemStatusData `json:"system_status,omitempty"`
+	BlockLimits map[string]batteryBlockLimits `json:"battery_block_limits,omitempty"`
+	Aggregates map[string]powerwall.MeterAggregatesData `json:"aggregates,omitempty"`
+	Meters map[string][]powerwall.MeterData `json:"meters,omitempty"`
+	// The extra readings for each meter in Meters (in the same order)
+	MeterReadings map[string][]meterExtraReadings `json:"meter_extra_readings,omitempty"`
+	Networks []powerwall.NetworkData `json:"networks,omitempty"`
+
+	// FetchTimes records when each API call completed, and Errors records
+	// the error returned by any which failed.  Both are keyed by the API
+	// path ("status", "system_status/soe", etc).
+	FetchTimes map[string]time.Time `json:"fetch_times"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// batteryBlockLimits holds the per-battery ratings which the system_status API
+// returns but go-powerwall doesn't decode.  Not all batteries report them, so
+// they are left nil if missing.
+type batteryBlockLimits struct {
+	NominalVoltage *float64 `json:"v_nominal,omitempty"`
+	MaxCurrent *float64 `json:"i_max,omitempty"`
+}
+
+// meterExtraReadings holds the per-meter readings which the meters API returns
+// but go-powerwall doesn't decode (those for the third phase, on three-phase
+// sites).
+type meterExtraReadings struct {
+	RealPowerC float32 `json:"real_power_c"`
+	ReactivePowerC float32 `json:"reactive_power_c"`
+	VL3N float32 `json:"v_l3n"`
+}
+
+// getSystemStatus fetches the system_status API, decoding it both the way
+// go-powerwall does and for the extra fields we want, so we only need to
+// fetch it once.  (The gatewayClient takes care of logging in, debug logging,
+// and tracing the same way go-powerwall would.)  The block limits are keyed by
+// battery serial number.  If any more fields are added here, the schema check
+// needs to know about them too (see schemaTypes).
+func (c *powerwallCollector) getSystemStatus(ctx context.Context) (*powerwall.SystemStatusData, map[string]batteryBlockLimits, error) {
+	body, _, err := c.gateway.get(ctx, "system_status")
+	if err != nil {
+		return nil, nil, err
+	}
+	sysstatus := &powerwall.SystemStatusData{}
+	err = json.Unmarshal(body, sysstatus)
+	if err != nil {
+		return nil, nil, err
+	}
+	var extra struct {
+		BatteryBlocks []struct {
+			PackageSerialNumber string `json:"PackageSerialNumber"`
+			batteryBlockLimits
+		} `json:"battery_blocks"`
+	}
+	err = json.Unmarshal(body, &extra)
+	if err != nil {
+		return nil, nil, err
+	}
+	limits := make(map[string]batteryBlockLimits)
+	for _, block := range extra.BatteryBlocks {
+		limits[block.PackageSerialNumber] = block.batteryBlockLimits
+	}
+	return sysstatus, limits, nil
+}
+
+// getMeters fetches the detailed meter data for a category, decoding it both
+// the way go-powerwall does and for the extra readings we want (the same way
+// as getSystemStatus).  The extra readings are in the same order as the
+// meters.
+func (c *powerwallCollector) getMeters(ctx context.Context, cat string) ([]powerwall.MeterData, []meterExtraReadings, error) {
+	body, _, err := c.gateway.get(ctx, "meters/" + url.PathEscape(cat))
+	if err != nil {
+		return nil, nil, err
+	}
+	devs := []powerwall.MeterData{}
+	err = json.Unmarshal(body, &devs)
+	if err != nil {
+		return nil, nil, err
+	}
+	var extra []struct {
+		CachedReadings meterExtraReadings `json:"Cached_readings"`
+	}
+	err = json.Unmarshal(body, &extra)
+	if err != nil {
+		return nil, nil, err
+	}
+	readings := make([]meterExtraReadings, len(devs))
+	for i := range readings {
+		readings[i] = extra[i].CachedReadings
+	}
+	return devs, readings, nil
+}
+
+// A collectionError records the most recent error which occurred while
+// fetching data from the gateway.
+type collectionError struct {
+	Time time.Time
+	API string
+	Message string
+}
+
+// recordFetch notes the completion of an API call in the snapshot, and logs
+// the error (if any).  It returns true if the error indicates that we can't
+// talk to the gateway at all, in which case there is no point trying to
+// fetch anything further.
+func (s *Snapshot) recordFetch(logger *log.Entry, api string, desc string, err error) bool {
+	s.FetchTimes[api] = time.Now()
+	if err == nil {
+		return false
+	}
+	s.Errors[api] = err.Error()
+	logger.WithFields(log.Fields{"err": err}).Errorf("Error fetching %s info", desc)
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// fetch retrieves a new snapshot of everything from the gateway.  The caller
+// must hold c.mu.
+func (c *powerwallCollector) fetch() *Snapshot {
+	ctx, span := tracer.Start(context.Background(), "Collect")
+	defer span.End()
+	logger := log.WithFields(traceLogFields(ctx))
+	var apiSpan trace.Span
+
+	logger.Debug("Collecting metrics...")
+
+	snap := &Snapshot{
+		Time: time.Now(),
+		FetchTimes: make(map[string]time.Time),
+		Errors: make(map[string]string),
+	}
+
+	apiSpan = startAPISpan(ctx, "GetStatus")
+	status, err := c.pw.GetStatus()
+	endAPISpan(apiSpan, err)
+	if snap.recordFetch(logger, "status", "status", err) {
+		return snap
+	} else if err == nil {
+		span.SetAttributes(
+			attribute.String("powerwall.gateway.din", status.Din),
+			attribute.String("powerwall.gateway.version", status.Version),
+		)
+		snap.Status = status
+	}
+
+	apiSpan = startAPISpan(ctx, "GetSOE")
+	soe, err := c.pw.GetSOE()
+	endAPISpan(apiSpan, err)
+	if snap.recordFetch(logger, "system_status/soe", "SOE", err) {
+		return snap
+	} else if err == nil {
+		snap.SOE = soe
+	}
+
+	apiSpan = startAPISpan(ctx, "GetOperation")
+	opdata, err := c.pw.GetOperation()
+	endAPISpan(apiSpan, err)
+	if snap.recordFetch(logger, "operation", "operation", err) {
+		return snap
+	} else if err == nil {
+		snap.Operation = opdata
+	}
+
+	apiSpan = startAPISpan(ctx, "GetSitemaster")
+	sitemaster, err := c.pw.GetSitemaster()
+	endAPISpan(apiSpan, err)
+	if snap.recordFetch(logger, "sitemaster", "sitemaster", err) {
+		return snap
+	} else if err == nil {
+		snap.Sitemaster = sitemaster
+	}
+
+	apiSpan = startAPISpan(ctx, "GetProblems")
+	problems, err := c.pw.GetProblems()
+	endAPISpan(apiSpan, err)
+	if snap.recordFetch(logger, "troubleshooting/problems", "troubleshooting problems", err) {
+		return snap
+	} else if err == nil {
+		snap.Problems = problems
+	}
+
+	// (This one doesn't go through go-powerwall; see getSystemStatus.)
+	apiCtx, apiSpan := startGatewaySpan(ctx, "GetSystemStatus")
+	sysstatus, limits, err := c.getSystemStatus(apiCtx)
+	endGatewaySpan(apiSpan, err)
+	if snap.recordFetch(logger, "system_status", "system_status", err) {
+		return snap
+	} else if err == nil {
+		snap.SystemStatus = sysstatus
+		snap.BlockLimits = limits
+	}
+
+	apiSpan = startAPISpan(ctx, "GetMetersAggregates")
+	aggs, err := c.pw.GetMetersAggregates()
+	endAPISpan(apiSpan, err)
+	if snap.recordFetch(logger, "meters/aggregates", "meter aggregates", err) {
+		return snap
+	} else if err == nil {
+		snap.Aggregates = *aggs
+		snap.Meters = make(map[string][]powerwall.MeterData)
+		snap.MeterReadings = make(map[string][]meterExtraReadings)
+		for cat := range *aggs {
+			// (These don't go through go-powerwall either; see
+			// getMeters.)
+			apiCtx, apiSpan := startGatewaySpan(ctx, "GetMeters")
+			apiSpan.SetAttributes(attribute.String("powerwall.category", cat))
+			devs, readings, err := c.getMeters(apiCtx, cat)
+			endGatewaySpan(apiSpan, err)
+			// Errors fetching individual meters are not fatal to
+			// the rest of the collection, even network ones.
+			snap.recordFetch(logger.WithFields(log.Fields{"cat": cat}), "meters/" + cat, "detailed meter", err)
+			if err == nil {
+				for i := range devs {
+					// We never need these, and would rather
+					// not be holding onto (or handing out)
+					// the meters' TLS keys.
+					devs[i].Connection.HTTPSConf.ClientCert = ""
+					devs[i].Connection.HTTPSConf.ClientKey = ""
+					devs[i].Connection.HTTPSConf.ServerCaCert = ""
+				}
+				snap.Meters[cat] = devs
+				snap.MeterReadings[cat] = readings
+			}
+		}
+	}
+
+	apiSpan = startAPISpan(ctx, "GetNetworks")
+	nets, err := c.pw.GetNetworks()
+	endAPISpan(apiSpan, err)
+	if snap.recordFetch(logger, "networks", "networks", err) {
+		return snap
+	} else if err == nil {
+		snap.Networks = *nets
+	}
+
+	return snap
+}
+
+// siteInfo fetches the gateway's site info.  This hardly ever changes, so it
+// isn't part of the snapshot, but it is still fetched with c.mu held so it
+// doesn't get mixed up with collections.
+func (c *powerwallCollector) siteInfo() (*powerwall.SiteInfoData, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctx, span := tracer.Start(context.Background(), "SiteInfo")
+	defer span.End()
+	apiSpan := startAPISpan(ctx, "GetSiteInfo")
+	siteinfo, err := c.pw.GetSiteInfo()
+	endAPISpan(apiSpan, err)
+	return siteinfo, err
+}
+
+// snapshot returns the most recent snapshot, as long as it is no older than
+// maxAge.  Otherwise, it fetches a new one from the gateway.
+func (c *powerwallCollector) snapshot(maxAge time.Duration) *Snapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.latest != nil && time.Since(c.latest.Time) <= maxAge {
+		return c.latest
+	}
+	c.latest = c.fetch()
+	for api, msg := range c.latest.Errors {
+		t := c.latest.FetchTimes[api]
+		if c.lastError == nil || !t.Before(c.lastError.Time) {
+			c.lastError = &collectionError{Time: t, API: api, Message: msg}
+		}
+	}
+	for _, f := range c.listeners {
+		f(c.latest)
+	}
+	return c.latest
+}
+
+// addListener registers a function to be called with each new snapshot as it
+// is fetched.  Listeners are called with c.mu held, so they must not block
+// for any significant amount of time (or call back into the collector), and
+// must not modify the snapshot.
+func (c *powerwallCollector) addListener(f func(*Snapshot)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listeners = append(c.listeners, f)
+}
+
+// startPoller starts a background goroutine which fetches a new snapshot
+// every interval, whether or not anything has asked for one.  (If something
+// else has triggered a fetch recently, we don't bother doing another one.)  If
+// active is not nil, it is only polled while active returns true.
+func (c *powerwallCollector) startPoller(name string, interval time.Duration, active func() bool) {
+	log.WithFields(log.Fields{"poller": name, "interval": interval}).Info("Starting background poller")
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if active == nil || active() {
+				c.snapshot(interval / 2)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// lastCollectionError returns the most recent error encountered while
+// fetching data from the gateway (even if later fetches have succeeded), or
+// nil if there have never been any.
+func (c *powerwallCollector) lastCollectionError() *collectionError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastError
+}
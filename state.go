@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type StateConfig struct {
+	File string `yaml:"file"`
+}
+
+// A stateStore keeps small pieces of state which need to survive restarts
+// (peak demand, learned battery capacity, etc) in a single JSON file, with
+// each user of it storing its own data under a different key.  If no state
+// file is configured, nothing is persisted, but everything else still works.
+type stateStore struct {
+	filename string
+	mu sync.Mutex
+	data map[string]json.RawMessage
+}
+
+func loadStateStore(filename string) *stateStore {
+	s := &stateStore{
+		filename: filename,
+		data: make(map[string]json.RawMessage),
+	}
+	if filename == "" {
+		log.Info("No state file configured.  Tracked state will not be preserved across restarts.")
+		return s
+	}
+	logger := log.WithFields(log.Fields{"file": filename})
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		logger.Info("State file does not exist yet.  Starting with empty state.")
+		return s
+	} else if err != nil {
+		logger.Fatalf("Unable to read state file: %s", err)
+	}
+	err = json.Unmarshal(content, &s.data)
+	if err != nil {
+		// Better to start over than to refuse to run at all
+		logger.WithFields(log.Fields{"err": err}).Error("Unable to parse state file.  Starting with empty state.")
+		s.data = make(map[string]json.RawMessage)
+	}
+	logger.Info("Loaded saved state")
+	return s
+}
+
+// get decodes the saved state for key into v.  It returns false if there is
+// no (usable) saved state for that key.
+func (s *stateStore) get(key string, v interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	raw, ok := s.data[key]
+	if !ok {
+		return false
+	}
+	err := json.Unmarshal(raw, v)
+	if err != nil {
+		log.WithFields(log.Fields{"key": key, "err": err}).Warn("Ignoring invalid saved state")
+		return false
+	}
+	return true
+}
+
+// set replaces the saved state for key with v, and writes the state file out
+// to disk.  Callers should only do this when something has actually changed,
+// since it rewrites the whole file each time.
+func (s *stateStore) set(key string, v interface{}) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		log.WithFields(log.Fields{"key": key, "err": err}).Error("Unable to encode state")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = raw
+	if s.filename == "" {
+		return
+	}
+	err = s.write()
+	if err != nil {
+		log.WithFields(log.Fields{"file": s.filename, "err": err}).Error("Unable to write state file")
+	}
+}
+
+// write saves everything to the state file.  It writes to a temporary file
+// first and then renames it, so a crash partway through can't leave a
+// truncated file behind.  The caller must hold s.mu.
+func (s *stateStore) write() error {
+	content, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.filename), filepath.Base(s.filename) + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.filename)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultStreamMaxClients = 10
+	defaultStreamClientBuffer = 8
+	defaultStreamKeepalive = "30s"
+	defaultStreamInterval = "5s"
+)
+
+type StreamConfig struct {
+	MaxClients int `yaml:"max_clients"`
+	ClientBuffer int `yaml:"client_buffer"`
+	Keepalive time.Duration `yaml:"keepalive"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+func checkStreamConfig(c *StreamConfig) {
+	if c.MaxClients < 0 {
+		log.Fatal("stream.max_clients must not be negative")
+	}
+	if c.ClientBuffer < 1 {
+		log.Fatal("stream.client_buffer must be at least 1")
+	}
+	if c.Keepalive <= 0 {
+		log.Fatal("stream.keepalive must be greater than zero")
+	}
+	if c.Interval < 0 {
+		log.Fatal("stream.interval must not be negative")
+	}
+}
+
+// A streamEvent is the compact summary of a snapshot which is sent to
+// streaming clients.  Power values are in watts, and fields which could not
+// be fetched from the gateway are left out.
+type streamEvent struct {
+	Time time.Time `json:"timestamp"`
+	Site *float32 `json:"site_watts,omitempty"`
+	Solar *float32 `json:"solar_watts,omitempty"`
+	Battery *float32 `json:"battery_watts,omitempty"`
+	Load *float32 `json:"load_watts,omitempty"`
+	SOC *float32 `json:"soc_percent,omitempty"`
+	GridState string `json:"grid_state,omitempty"`
+}
+
+func newStreamEvent(snap *Snapshot) *streamEvent {
+	ev := &streamEvent{Time: snap.Time}
+	power := func(cat string) *float32 {
+		if data, ok := snap.Aggregates[cat]; ok {
+			return &data.InstantPower
+		}
+		return nil
+	}
+	ev.Site = power("site")
+	ev.Solar = power("solar")
+	ev.Battery = power("battery")
+	ev.Load = power("load")
+	if snap.SOE != nil {
+		ev.SOC = &snap.SOE.Percentage
+	}
+	if snap.SystemStatus != nil {
+		ev.GridState = snap.SystemStatus.SystemIslandState
+	}
+	return ev
+}
+
+// A streamHub keeps track of all of the currently connected streaming
+// clients, and sends each new event to all of them.
+type streamHub struct {
+	config *StreamConfig
+	mu sync.Mutex
+	clients map[chan []byte]bool
+	last []byte
+}
+
+func newStreamHub(c *StreamConfig) *streamHub {
+	return &streamHub{
+		config: c,
+		clients: make(map[chan []byte]bool),
+	}
+}
+
+// publish is registered as a collector listener, and sends the summary of
+// each new snapshot to all clients.  It never blocks: if a client is not
+// keeping up and its buffer is full, we throw away its oldest pending event
+// to make room (each event is a complete picture of the current state, so
+// it's better for a slow client to skip some than to fall further and
+// further behind).
+func (h *streamHub) publish(snap *Snapshot) {
+	data, err := json.Marshal(newStreamEvent(snap))
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Error encoding stream event")
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = data
+	for ch := range h.clients {
+		select {
+		case ch <- data:
+			continue
+		default:
+		}
+		// This client's buffer is full.  Discard the oldest event and
+		// try again (we're the only sender, so there will be room now)
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- data:
+		default:
+		}
+	}
+}
+
+// active returns true if any clients are connected (so the stream's poller
+// knows whether it needs to bother fetching anything).
+func (h *streamHub) active() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients) > 0
+}
+
+func (h *streamHub) register() (chan []byte, []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.clients) >= h.config.MaxClients {
+		return nil, nil
+	}
+	ch := make(chan []byte, h.config.ClientBuffer)
+	h.clients[ch] = true
+	return ch, h.last
+}
+
+func (h *streamHub) unregister(ch chan []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, ch)
+}
+
+// ServeHTTP streams events to the client using the Server-Sent Events
+// protocol until the client disconnects.
+func (h *streamHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// A HEAD request has no body to stream to, so don't tie up a client
+	// slot waiting for it to disconnect.
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch, last := h.register()
+	if ch == nil {
+		log.WithFields(log.Fields{"remote": r.RemoteAddr}).Warn("Rejecting stream client: too many clients")
+		http.Error(w, "Too many clients", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.unregister(ch)
+	log.WithFields(log.Fields{"remote": r.RemoteAddr}).Debug("Stream client connected")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	// Start new clients off with the most recent data we have, so they
+	// don't have to wait for the next poll to show anything.
+	if last != nil {
+		fmt.Fprintf(w, "data: %s\n\n", last)
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(h.config.Keepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			log.WithFields(log.Fields{"remote": r.RemoteAddr}).Debug("Stream client disconnected")
+			return
+		case data := <-ch:
+			_, err := fmt.Fprintf(w, "data: %s\n\n", data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			// SSE comment lines are ignored by clients, but keep
+			// idle connections from being timed out by proxies.
+			_, err := fmt.Fprint(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStreamHubMethods(t *testing.T) {
+	tests := []struct {
+		name string
+		method string
+		want int
+	}{
+		{"head", http.MethodHead, http.StatusOK},
+		{"post", http.MethodPost, http.StatusMethodNotAllowed},
+		{"put", http.MethodPut, http.StatusMethodNotAllowed},
+		{"delete", http.MethodDelete, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newStreamHub(&StreamConfig{MaxClients: 1, ClientBuffer: 1})
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, "/api/v1/stream", nil))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if len(h.clients) != 0 {
+				t.Errorf("%d clients still registered", len(h.clients))
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	tariffDaysAll = "all"
+	tariffDaysWeekday = "weekday"
+	tariffDaysWeekend = "weekend"
+
+	tariffStateKey = "tariff"
+)
+
+type TariffConfig struct {
+	DailyCharge float64 `yaml:"daily_charge"`
+	Seasons []TariffSeason `yaml:"seasons"`
+}
+
+// A TariffSeason applies during the listed months (or all year, if none are
+// listed).
+type TariffSeason struct {
+	Name string `yaml:"name"`
+	Months []int `yaml:"months"`
+	Rates []TariffRate `yaml:"rates"`
+}
+
+// A TariffRate gives the price per kWh of imported and exported energy for a
+// range of hours (from start_hour up to, but not including, end_hour) on
+// particular days.  If start_hour is after end_hour, the range wraps around
+// midnight.
+type TariffRate struct {
+	Days string `yaml:"days"`
+	StartHour int `yaml:"start_hour"`
+	EndHour *int `yaml:"end_hour"`
+	Import float64 `yaml:"import"`
+	Export float64 `yaml:"export"`
+}
+
+func setTariffDefaults(c *TariffConfig) {
+	for i := range c.Seasons {
+		for j := range c.Seasons[i].Rates {
+			r := &c.Seasons[i].Rates[j]
+			if r.Days == "" {
+				r.Days = tariffDaysAll
+			}
+			if r.EndHour == nil {
+				end := 24
+				r.EndHour = &end
+			}
+		}
+	}
+}
+
+func checkTariffConfig(c *TariffConfig) {
+	if len(c.Seasons) == 0 {
+		log.Fatal("Required parameter tariff.seasons not specified in config file")
+	}
+	for _, season := range c.Seasons {
+		for _, m := range season.Months {
+			if m < 1 || m > 12 {
+				log.Fatalf("Invalid month %d in tariff season %q (must be 1-12)", m, season.Name)
+			}
+		}
+		if len(season.Rates) == 0 {
+			log.Fatalf("Tariff season %q has no rates", season.Name)
+		}
+		for _, r := range season.Rates {
+			if r.Days != tariffDaysAll && r.Days != tariffDaysWeekday && r.Days != tariffDaysWeekend {
+				log.Fatalf("Invalid days %q in tariff season %q (must be %q, %q, or %q)", r.Days, season.Name, tariffDaysAll, tariffDaysWeekday, tariffDaysWeekend)
+			}
+			if r.StartHour < 0 || r.StartHour > 23 || *r.EndHour < 0 || *r.EndHour > 24 {
+				log.Fatalf("Invalid hours %d-%d in tariff season %q", r.StartHour, *r.EndHour, season.Name)
+			}
+		}
+	}
+}
+
+// rate returns the tariff rate in effect at the given time (in the site
+// timezone).  The first matching rate of the first matching season wins.
+func (c *TariffConfig) rate(t time.Time) *TariffRate {
+	t = t.In(config.Site.location)
+	month := int(t.Month())
+	hour := t.Hour()
+	weekend := t.Weekday() == time.Saturday || t.Weekday() == time.Sunday
+	for _, season := range c.Seasons {
+		if len(season.Months) > 0 {
+			found := false
+			for _, m := range season.Months {
+				found = found || m == month
+			}
+			if !found {
+				continue
+			}
+		}
+		for i, r := range season.Rates {
+			if (r.Days == tariffDaysWeekday && weekend) || (r.Days == tariffDaysWeekend && !weekend) {
+				continue
+			}
+			if r.StartHour <= *r.EndHour {
+				if hour < r.StartHour || hour >= *r.EndHour {
+					continue
+				}
+			} else if hour < r.StartHour && hour >= *r.EndHour {
+				continue
+			}
+			return &season.Rates[i]
+		}
+	}
+	return nil
+}
+
+// tariffState is saved across restarts.
+type tariffState struct {
+	// The day the fixed charge was last added for, so that the same day
+	// isn't charged for twice.
+	LastDay time.Time `json:"last_day"`
+}
+
+// tariffTracker works out how much grid imports have cost and exports have
+// earned, according to the configured tariff, along with how much it would
+// have cost to import the energy the home got from solar and the batteries
+// instead.
+type tariffTracker struct {
+	config *TariffConfig
+	store *stateStore
+	mu sync.Mutex
+	last *energySample
+	state tariffState
+	importCost float64
+	exportCredit float64
+	avoidedCost float64
+	fixedCharges float64
+}
+
+func newTariffTracker(c *powerwallCollector, tc *TariffConfig, store *stateStore) *tariffTracker {
+	c.newDesc("grid_import_cost_total", "Cost of energy imported from the grid since the exporter started, according to the configured tariff", nil)
+	c.newDesc("grid_export_credit_total", "Credit earned for energy exported to the grid since the exporter started, according to the configured tariff", nil)
+	c.newDesc("grid_avoided_cost_total", "Cost which would have been paid to import the energy the home got from solar and batteries instead, since the exporter started", nil)
+	c.newDesc("grid_fixed_charges_total", "Fixed daily charges accrued since the exporter started, according to the configured tariff", nil)
+	t := &tariffTracker{config: tc, store: store}
+	if store.get(tariffStateKey, &t.state) {
+		log.WithFields(log.Fields{"last_day": t.state.LastDay}).Info("Restored tariff state")
+	}
+	return t
+}
+
+func (t *tariffTracker) update(snap *Snapshot) {
+	s, ok := newEnergySample(snap)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last != nil && s.zeroReading(*t.last) {
+		return
+	}
+
+	y, m, d := s.time.In(config.Site.location).Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, config.Site.location)
+	if !day.Equal(t.state.LastDay) {
+		t.fixedCharges += t.config.DailyCharge
+		t.state.LastDay = day
+		t.store.set(tariffStateKey, &t.state)
+	}
+
+	// If there's a long gap (the exporter wasn't running, or couldn't
+	// reach the gateway), we can't tell when the energy was used, so
+	// we can't price it.
+	if t.last != nil && !s.counterReset(*t.last) && s.time.Sub(t.last.time) <= maxFlowIntegrationGap {
+		// Use whatever rate was in effect halfway through the
+		// interval (intervals are normally short enough that this
+		// doesn't matter much).
+		mid := t.last.time.Add(s.time.Sub(t.last.time) / 2)
+		if r := t.config.rate(mid); r != nil {
+			imported := (s.siteImported - t.last.siteImported) / 1000
+			exported := (s.siteExported - t.last.siteExported) / 1000
+			load := (s.loadImported - t.last.loadImported) / 1000
+			t.importCost += imported * r.Import
+			t.exportCredit += exported * r.Export
+			// Some of the imported energy may have gone into the
+			// batteries rather than the home, so work out where
+			// it all went the same way as the energy flows.
+			solar := (s.solarExported - t.last.solarExported) / 1000
+			battery := ((s.batteryExported - t.last.batteryExported) - (s.batteryImported - t.last.batteryImported)) / 1000
+			flows := splitFlows(solar, imported - exported, battery, load)
+			t.avoidedCost += math.Max(load - flows[energyFlow{"grid", "home"}], 0) * r.Import
+		}
+	}
+	t.last = &s
+}
+
+func (t *tariffTracker) collect(c *powerwallCollector, ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last == nil {
+		return
+	}
+	c.setCounter64(ch, "grid_import_cost_total", t.importCost)
+	c.setCounter64(ch, "grid_export_credit_total", t.exportCredit)
+	c.setCounter64(ch, "grid_avoided_cost_total", t.avoidedCost)
+	c.setCounter64(ch, "grid_fixed_charges_total", t.fixedCharges)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func intp(v int) *int {
+	return &v
+}
+
+// setSiteTimezone switches the site timezone for the duration of a test.
+func setSiteTimezone(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("timezone %s not available: %s", name, err)
+	}
+	saved := config.Site.location
+	config.Site.location = loc
+	t.Cleanup(func() { config.Site.location = saved })
+	return loc
+}
+
+func testTariff() *TariffConfig {
+	tc := &TariffConfig{
+		DailyCharge: 1,
+		Seasons: []TariffSeason{
+			{
+				Name: "summer",
+				Months: []int{6, 7, 8, 9},
+				Rates: []TariffRate{
+					{Days: "weekday", StartHour: 16, EndHour: intp(21), Import: 0.6},
+					{Import: 0.3},
+				},
+			},
+			{
+				Name: "winter",
+				Rates: []TariffRate{
+					{Days: "weekday", StartHour: 17, EndHour: intp(21), Import: 0.5, Export: 0.1},
+					{StartHour: 21, EndHour: intp(7), Import: 0.1, Export: 0.05},
+					{Days: "weekend", StartHour: 7, Import: 0.15},
+				},
+			},
+		},
+	}
+	setTariffDefaults(tc)
+	return tc
+}
+
+func TestTariffRate(t *testing.T) {
+	loc := setSiteTimezone(t, "America/Los_Angeles")
+	tc := testTariff()
+	tests := []struct {
+		name string
+		time time.Time
+		want float64 // import rate, or -1 for no rate
+	}{
+		{"weekday peak start", time.Date(2024, 1, 10, 17, 0, 0, 0, loc), 0.5},
+		{"weekday peak last minute", time.Date(2024, 1, 10, 20, 59, 59, 0, loc), 0.5},
+		{"overnight start", time.Date(2024, 1, 10, 21, 0, 0, 0, loc), 0.1},
+		{"overnight before midnight", time.Date(2024, 1, 10, 23, 59, 59, 0, loc), 0.1},
+		{"overnight after midnight", time.Date(2024, 1, 11, 0, 0, 0, 0, loc), 0.1},
+		{"overnight end", time.Date(2024, 1, 11, 6, 59, 59, 0, loc), 0.1},
+		{"weekday gap", time.Date(2024, 1, 11, 7, 0, 0, 0, loc), -1},
+		{"weekend day", time.Date(2024, 1, 13, 18, 0, 0, 0, loc), 0.15},
+		{"weekend overnight", time.Date(2024, 1, 13, 22, 0, 0, 0, loc), 0.1},
+		{"summer weekday peak", time.Date(2024, 7, 10, 16, 0, 0, 0, loc), 0.6},
+		{"summer otherwise", time.Date(2024, 7, 10, 21, 0, 0, 0, loc), 0.3},
+		{"season boundary", time.Date(2024, 9, 30, 23, 59, 59, 0, loc), 0.3},
+		{"season boundary after", time.Date(2024, 10, 1, 0, 0, 0, 0, loc), 0.1},
+		// 2024-03-10 is a Sunday, and clocks go forward at 2am.
+		// 17:30 PDT would be 16:30 if we forgot about DST.
+		{"DST start early", time.Date(2024, 3, 10, 9, 30, 0, 0, time.UTC), 0.1},  // 01:30 PST
+		{"DST start late", time.Date(2024, 3, 10, 10, 30, 0, 0, time.UTC), 0.1},  // 03:30 PDT
+		{"DST start weekday peak", time.Date(2024, 3, 12, 0, 30, 0, 0, time.UTC), 0.5}, // Monday 17:30 PDT
+		// 2024-11-03: clocks go back at 2am, so 01:30 happens twice
+		{"DST end first", time.Date(2024, 11, 3, 8, 30, 0, 0, time.UTC), 0.1},
+		{"DST end second", time.Date(2024, 11, 3, 9, 30, 0, 0, time.UTC), 0.1},
+		{"DST end weekday peak", time.Date(2024, 11, 5, 1, 30, 0, 0, time.UTC), 0.5}, // Monday 17:30 PST
+		{"DST end weekday before peak", time.Date(2024, 11, 5, 0, 30, 0, 0, time.UTC), -1}, // Monday 16:30 PST
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tc.rate(tt.time)
+			got := -1.0
+			if r != nil {
+				got = r.Import
+			}
+			if got != tt.want {
+				t.Errorf("rate(%s) = %g, want %g", tt.time.In(loc), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTariffTracker(t *testing.T) {
+	setSiteTimezone(t, "UTC")
+	// Every step imports 1 Wh from the grid, and exports nothing.
+	lifetime := energySample{
+		loadImported: 2000000,
+		siteImported: 1000000,
+		siteExported: 50000,
+		solarExported: 100000,
+		batteryImported: 30000,
+	}
+	step := func(n int) energySample {
+		s := lifetime
+		s.loadImported += float64(n)
+		s.siteImported += float64(n)
+		return s
+	}
+	start := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC) // flat 0.2/kWh rate
+	tests := []struct {
+		name string
+		samples []energySample
+		times []time.Duration // offsets from start
+		want float64
+	}{
+		{
+			name: "steady",
+			samples: []energySample{step(0), step(10), step(20), step(30)},
+			times: []time.Duration{0, time.Minute, 2 * time.Minute, 3 * time.Minute},
+			want: 0.006,
+		},
+		{
+			name: "zero reading",
+			samples: []energySample{step(0), step(10), {}, step(30)},
+			times: []time.Duration{0, time.Minute, 2 * time.Minute, 3 * time.Minute},
+			want: 0.006,
+		},
+		{
+			name: "long gap",
+			samples: []energySample{step(0), step(10), step(1000), step(1010)},
+			times: []time.Duration{0, time.Minute, 5 * time.Hour, 5 * time.Hour + time.Minute},
+			want: 0.004,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := &TariffConfig{Seasons: []TariffSeason{{Rates: []TariffRate{{Import: 0.2}}}}}
+			setTariffDefaults(tc)
+			tracker := newTariffTracker(newTestCollector(t), tc, loadStateStore(""))
+			for i, s := range tt.samples {
+				tracker.update(energySnapshot(start.Add(tt.times[i]), s))
+			}
+			if math.Abs(tracker.importCost - tt.want) > 1e-9 {
+				t.Errorf("import cost = %g, want %g", tracker.importCost, tt.want)
+			}
+		})
+	}
+}
+
+func TestTariffAvoidedCost(t *testing.T) {
+	setSiteTimezone(t, "UTC")
+	lifetime := energySample{
+		loadImported: 2000000,
+		siteImported: 1000000,
+		siteExported: 50000,
+		solarExported: 100000,
+		batteryImported: 30000,
+		batteryExported: 25000,
+	}
+	start := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC) // flat 0.2/kWh rate
+	tests := []struct {
+		name string
+		delta energySample // change in each counter over one minute (Wh)
+		want float64
+	}{
+		{"all from grid", energySample{loadImported: 1000, siteImported: 1000}, 0},
+		{"all from solar", energySample{loadImported: 1000, solarExported: 1500, siteExported: 500}, 0.2},
+		{"solar and grid", energySample{loadImported: 1000, solarExported: 400, siteImported: 600}, 0.08},
+		{"all from battery", energySample{loadImported: 1000, batteryExported: 1000}, 0.2},
+		// The grid import all went into the battery, so the home was
+		// still entirely powered by solar.
+		{"grid charging battery", energySample{loadImported: 1000, solarExported: 1000, siteImported: 3000, batteryImported: 3000}, 0.2},
+		{"grid charging battery and powering home", energySample{loadImported: 1000, siteImported: 4000, batteryImported: 3000}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := &TariffConfig{Seasons: []TariffSeason{{Rates: []TariffRate{{Import: 0.2}}}}}
+			setTariffDefaults(tc)
+			tracker := newTariffTracker(newTestCollector(t), tc, loadStateStore(""))
+			end := lifetime
+			end.loadImported += tt.delta.loadImported
+			end.siteImported += tt.delta.siteImported
+			end.siteExported += tt.delta.siteExported
+			end.solarExported += tt.delta.solarExported
+			end.batteryImported += tt.delta.batteryImported
+			end.batteryExported += tt.delta.batteryExported
+			tracker.update(energySnapshot(start, lifetime))
+			tracker.update(energySnapshot(start.Add(time.Minute), end))
+			if math.Abs(tracker.avoidedCost - tt.want) > 1e-9 {
+				t.Errorf("avoided cost = %g, want %g", tracker.avoidedCost, tt.want)
+			}
+		})
+	}
+}
+
+func TestTariffDailyCharge(t *testing.T) {
+	setSiteTimezone(t, "UTC")
+	s := energySample{loadImported: 2000000, siteImported: 1000000}
+	start := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// Offsets from start of the samples before and after a restart
+		before []time.Duration
+		after []time.Duration
+		want float64 // charges after the restart
+	}{
+		{"same day", []time.Duration{0, time.Minute}, []time.Duration{2 * time.Minute}, 0},
+		{"next day", []time.Duration{0, time.Minute}, []time.Duration{13 * time.Hour}, 1.5},
+		{"next day before and after", []time.Duration{0, 12 * time.Hour}, []time.Duration{13 * time.Hour}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := &TariffConfig{DailyCharge: 1.5, Seasons: []TariffSeason{{Rates: []TariffRate{{Import: 0.2}}}}}
+			setTariffDefaults(tc)
+			statefile := filepath.Join(t.TempDir(), "state.json")
+			tracker := newTariffTracker(newTestCollector(t), tc, loadStateStore(statefile))
+			for _, offset := range tt.before {
+				tracker.update(energySnapshot(start.Add(offset), s))
+			}
+			tracker = newTariffTracker(newTestCollector(t), tc, loadStateStore(statefile))
+			for _, offset := range tt.after {
+				tracker.update(energySnapshot(start.Add(offset), s))
+			}
+			if tracker.fixedCharges != tt.want {
+				t.Errorf("fixed charges = %g, want %g", tracker.fixedCharges, tt.want)
+			}
+		})
+	}
+}
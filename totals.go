@@ -0,0 +1,149 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	totalsStateKey = "energy_totals"
+	// Save the latest counter values at least this often, so that if we
+	// are restarted across midnight, we still have a reasonable baseline
+	// for the new day.
+	totalsSaveInterval = time.Minute
+	// If the last values we saw are older than this when a new day
+	// starts, they're too stale to use as a baseline for it.
+	totalsMaxBaselineAge = time.Hour
+)
+
+// totalsState is saved across restarts.  Counter values (in joules) are
+// keyed by "<category>/<direction>".
+type totalsState struct {
+	Day string `json:"day"`
+	Month string `json:"month"`
+	DayBaseline map[string]float64 `json:"day_baseline"`
+	MonthBaseline map[string]float64 `json:"month_baseline"`
+	Last map[string]float64 `json:"last"`
+	LastTime time.Time `json:"last_time"`
+}
+
+// totalsTracker works out energy imported and exported for each category
+// today and this month (in the site timezone), by remembering the lifetime
+// counter values at the start of each day and month.
+type totalsTracker struct {
+	store *stateStore
+	mu sync.Mutex
+	state totalsState
+	saved time.Time
+}
+
+func newTotalsTracker(c *powerwallCollector, store *stateStore) *totalsTracker {
+	c.newDesc("energy_today_joules", "Energy imported or exported since midnight (site timezone)", []string{"category", "direction"})
+	c.newDesc("energy_month_joules", "Energy imported or exported since the start of the month (site timezone)", []string{"category", "direction"})
+	t := &totalsTracker{store: store}
+	if store.get(totalsStateKey, &t.state) {
+		log.WithFields(log.Fields{"day": t.state.Day}).Info("Restored daily energy totals state")
+	}
+	if t.state.Last == nil {
+		t.state = totalsState{
+			DayBaseline: make(map[string]float64),
+			MonthBaseline: make(map[string]float64),
+			Last: make(map[string]float64),
+		}
+	}
+	return t
+}
+
+func (t *totalsTracker) update(snap *Snapshot) {
+	if len(snap.Aggregates) == 0 {
+		return
+	}
+	local := snap.Time.In(config.Site.location)
+	day := local.Format("2006-01-02")
+	month := local.Format("2006-01")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &t.state
+	changed := false
+
+	// When a new day or month starts, the last values we saw are the
+	// closest thing we have to the values at midnight (as long as they
+	// are reasonably recent).  If they aren't, the baselines will get
+	// filled in from the current values instead.
+	recent := snap.Time.Sub(s.LastTime) <= totalsMaxBaselineAge
+	if day != s.Day {
+		s.DayBaseline = make(map[string]float64)
+		if recent {
+			for k, v := range s.Last {
+				s.DayBaseline[k] = v
+			}
+		}
+		s.Day = day
+		changed = true
+	}
+	if month != s.Month {
+		s.MonthBaseline = make(map[string]float64)
+		if recent {
+			for k, v := range s.Last {
+				s.MonthBaseline[k] = v
+			}
+		}
+		s.Month = month
+		changed = true
+	}
+
+	for cat, data := range snap.Aggregates {
+		values := map[string]float32{"imported": data.EnergyImported, "exported": data.EnergyExported}
+		for direction, wh := range values {
+			key := cat + "/" + direction
+			if wh == 0 {
+				// The gateway sometimes reports zero for a
+				// while when starting up (see the comment in
+				// Collect).  That isn't a real reset, so we
+				// just wait for the proper value to come back.
+				continue
+			}
+			v := float64(wh) * 3600
+			if last, ok := s.Last[key]; ok && v < last {
+				// The gateway has reset its counters.  Shift
+				// the baselines so the totals carry on from
+				// where they were.
+				s.DayBaseline[key] -= last
+				s.MonthBaseline[key] -= last
+				changed = true
+			}
+			if _, ok := s.DayBaseline[key]; !ok {
+				s.DayBaseline[key] = v
+				changed = true
+			}
+			if _, ok := s.MonthBaseline[key]; !ok {
+				s.MonthBaseline[key] = v
+				changed = true
+			}
+			s.Last[key] = v
+		}
+	}
+	s.LastTime = snap.Time
+
+	if changed || snap.Time.Sub(t.saved) >= totalsSaveInterval {
+		t.store.set(totalsStateKey, s)
+		t.saved = snap.Time
+	}
+}
+
+func (t *totalsTracker) collect(c *powerwallCollector, ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &t.state
+	for key, v := range s.Last {
+		i := strings.LastIndex(key, "/")
+		cat, direction := key[:i], key[i+1:]
+		c.setGauge64(ch, "energy_today_joules", v - s.DayBaseline[key], cat, direction)
+		c.setGauge64(ch, "energy_month_joules", v - s.MonthBaseline[key], cat, direction)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+)
+
+// siteSnapshot returns a snapshot with only the site aggregate filled in, with
+// the given imported and exported energy (in Wh).
+func siteSnapshot(when time.Time, imported, exported float32) *Snapshot {
+	return &Snapshot{
+		Time: when,
+		Aggregates: map[string]powerwall.MeterAggregatesData{
+			"site": {EnergyImported: imported, EnergyExported: exported},
+		},
+	}
+}
+
+func TestTotalsTracker(t *testing.T) {
+	start := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// Imported Wh, one sample per minute from start (or
+		// given explicit times, if times is set)
+		imported []float32
+		times []time.Time
+		wantDay float64
+		wantMonth float64
+	}{
+		{
+			name: "steady",
+			imported: []float32{1000000, 1000010, 1000020},
+			wantDay: 20,
+			wantMonth: 20,
+		},
+		{
+			name: "zero reading",
+			imported: []float32{1000000, 1000010, 0, 1000020},
+			wantDay: 20,
+			wantMonth: 20,
+		},
+		{
+			name: "zero at start",
+			imported: []float32{0, 1000000, 1000010},
+			wantDay: 10,
+			wantMonth: 10,
+		},
+		{
+			name: "real reset",
+			imported: []float32{1000000, 1000010, 5, 15},
+			wantDay: 25,
+			wantMonth: 25,
+		},
+		{
+			name: "new day",
+			imported: []float32{1000000, 1000010, 1000030, 1000035},
+			times: []time.Time{
+				time.Date(2024, 3, 10, 23, 58, 0, 0, time.UTC),
+				time.Date(2024, 3, 10, 23, 59, 0, 0, time.UTC),
+				time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC),
+				time.Date(2024, 3, 11, 0, 1, 0, 0, time.UTC),
+			},
+			wantDay: 25,
+			wantMonth: 35,
+		},
+		{
+			name: "new day after long gap",
+			imported: []float32{1000000, 1000500, 1000510},
+			times: []time.Time{
+				time.Date(2024, 3, 10, 20, 0, 0, 0, time.UTC),
+				time.Date(2024, 3, 11, 6, 0, 0, 0, time.UTC),
+				time.Date(2024, 3, 11, 6, 1, 0, 0, time.UTC),
+			},
+			wantDay: 10,
+			wantMonth: 510,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newTotalsTracker(newTestCollector(t), loadStateStore(""))
+			for i, wh := range tt.imported {
+				when := start.Add(time.Duration(i) * time.Minute)
+				if tt.times != nil {
+					when = tt.times[i]
+				}
+				tracker.update(siteSnapshot(when, wh, 100))
+			}
+			s := tracker.state
+			day := (s.Last["site/imported"] - s.DayBaseline["site/imported"]) / 3600
+			month := (s.Last["site/imported"] - s.MonthBaseline["site/imported"]) / 3600
+			if math.Abs(day - tt.wantDay) > 0.01 {
+				t.Errorf("today's import = %g Wh, want %g", day, tt.wantDay)
+			}
+			if math.Abs(month - tt.wantMonth) > 0.01 {
+				t.Errorf("month's import = %g Wh, want %g", month, tt.wantMonth)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// If tracing is not enabled, the global tracer provider is a no-op one, so
+// it's always safe to create spans with this.
+var tracer = otel.Tracer(exporterName + "_exporter")
+
+// startTracing sets up exporting of trace spans via OTLP.  Unlike metrics, we
+// don't wait to talk to the gateway before starting (traces are most useful
+// precisely when we can't talk to it), so the gateway information is recorded
+// as attributes on the individual spans instead of on the resource.
+func startTracing(c *OTLPConfig) {
+	exporter, err := newOTLPTraceExporter(c)
+	if err != nil {
+		log.Fatalf("Unable to create OTLP trace exporter: %s", err)
+	}
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName(exporterName + "_exporter"),
+		semconv.ServiceVersion(exporterVersion),
+	}
+	for k, v := range c.ResourceAttributes {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, attrs...)),
+	)
+	otel.SetTracerProvider(provider)
+	log.WithFields(log.Fields{"protocol": c.Protocol, "endpoint": c.Endpoint}).Info("Exporting traces via OTLP")
+}
+
+func newOTLPTraceExporter(c *OTLPConfig) (sdktrace.SpanExporter, error) {
+	ctx := context.Background()
+	if c.Protocol == otlpProtocolHTTP {
+		opts := []otlptracehttp.Option{}
+		if c.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(c.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(c.Headers))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+	opts := []otlptracegrpc.Option{}
+	if c.Endpoint != "" {
+		opts = append(opts, otlptracegrpc.WithEndpoint(c.Endpoint))
+	}
+	if c.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	if len(c.Headers) > 0 {
+		opts = append(opts, otlptracegrpc.WithHeaders(c.Headers))
+	}
+	return otlptracegrpc.New(ctx, opts...)
+}
+
+// traceLogFields returns log fields identifying the span in the given
+// context (if any), so log messages can be matched up with traces.
+func traceLogFields(ctx context.Context) log.Fields {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return log.Fields{}
+	}
+	return log.Fields{"trace_id": sc.TraceID().String(), "span_id": sc.SpanID().String()}
+}
+
+// The go-powerwall library does not give us any way to hook into the
+// individual HTTP requests it makes, so the only insight we have into what it
+// is doing (retries, logins, etc) is from its debug log messages.  We keep
+// track of the span for the API call currently in progress, so that we can
+// attach those details to it as they are logged.  Since the log messages
+// don't say which call they came from, clientLock makes sure only one thing
+// (a collection, or a login by the gatewayClient) is using the client at a
+// time, so the messages always end up on the right span.
+var clientLock sync.Mutex
+var apiSpanLock sync.Mutex
+var apiSpanCtx context.Context
+var loginSpan trace.Span
+
+// startAPISpan starts a child span for a single go-powerwall API call.  The
+// caller must call endAPISpan when the call returns.
+func startAPISpan(ctx context.Context, name string) trace.Span {
+	ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	beginClientCall(ctx)
+	return span
+}
+
+func endAPISpan(span trace.Span, err error) {
+	endClientCall()
+	endGatewaySpan(span, err)
+}
+
+// startGatewaySpan starts a child span for a single raw API call made with
+// the gatewayClient (which records what it is doing on the span itself).  The
+// caller must call endGatewaySpan when the call returns.
+func startGatewaySpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+}
+
+func endGatewaySpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// beginClientCall must be called before using the go-powerwall client, so
+// that its log messages are attributed to the span in ctx.  The caller must
+// call endClientCall when done.
+func beginClientCall(ctx context.Context) {
+	clientLock.Lock()
+	apiSpanLock.Lock()
+	apiSpanCtx = ctx
+	apiSpanLock.Unlock()
+}
+
+func endClientCall() {
+	apiSpanLock.Lock()
+	if loginSpan != nil {
+		// Shouldn't normally happen, but just in case we somehow
+		// missed the end of a login...
+		loginSpan.End()
+		loginSpan = nil
+	}
+	apiSpanCtx = nil
+	apiSpanLock.Unlock()
+	clientLock.Unlock()
+}
+
+// traceClientLog is called with each log message from the go-powerwall
+// library, and records relevant ones against the current API span.  It
+// returns log fields identifying the span the message belongs to.
+func traceClientLog(msg string) log.Fields {
+	// Messages are prefixed with "{<client pointer>} "
+	if i := strings.Index(msg, "} "); i >= 0 {
+		msg = msg[i+2:]
+	}
+
+	apiSpanLock.Lock()
+	defer apiSpanLock.Unlock()
+	if apiSpanCtx == nil {
+		return log.Fields{}
+	}
+	ctx := apiSpanCtx
+	span := trace.SpanFromContext(ctx)
+	if loginSpan != nil {
+		ctx = trace.ContextWithSpan(ctx, loginSpan)
+		span = loginSpan
+	}
+
+	switch {
+	case strings.HasPrefix(msg, "Attempting login"):
+		ctx, loginSpan = tracer.Start(ctx, "Login", trace.WithSpanKind(trace.SpanKindClient))
+	case strings.HasPrefix(msg, "Login successful"):
+		if loginSpan != nil {
+			loginSpan.End()
+			loginSpan = nil
+		}
+	case strings.HasPrefix(msg, "Login failed"):
+		if loginSpan != nil {
+			loginSpan.SetStatus(codes.Error, msg)
+			loginSpan.End()
+			loginSpan = nil
+		}
+	case strings.HasPrefix(msg, "Calling API:"):
+		// Note: this may include the request body, so we only record
+		// the method and URL.
+		fields := strings.Fields(msg)
+		for _, f := range fields {
+			if strings.HasPrefix(f, "method=") {
+				span.SetAttributes(semconv.HTTPRequestMethodKey.String(strings.TrimPrefix(f, "method=")))
+			} else if strings.HasPrefix(f, "url=") {
+				span.SetAttributes(semconv.URLFull(strings.TrimPrefix(f, "url=")))
+			}
+		}
+		span.AddEvent("request")
+	case strings.HasPrefix(msg, "Network error fetching API"):
+		span.AddEvent("retry", trace.WithAttributes(attribute.String("message", msg)))
+	case strings.HasPrefix(msg, "API request returned status"):
+		span.AddEvent("re-auth", trace.WithAttributes(attribute.String("message", msg)))
+	case strings.HasPrefix(msg, "Request succeeded:"), strings.HasPrefix(msg, "Request failed:"):
+		fields := strings.Fields(msg)
+		if len(fields) > 2 && strings.HasPrefix(fields[2], "status=") {
+			code, err := strconv.Atoi(strings.TrimPrefix(fields[2], "status="))
+			if err == nil {
+				span.SetAttributes(semconv.HTTPResponseStatusCode(code))
+			}
+		}
+	}
+	return traceLogFields(ctx)
+}